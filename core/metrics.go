@@ -8,28 +8,52 @@ import (
 
 type TreeMetrics struct {
 	PoolGet       int64
+	PoolHit       int64
 	PoolReturn    int64
 	PoolEvict     int64
 	PoolEvictMiss int64
 	PoolFault     int64
+	PoolWriteback int64
+
+	// PoolBytes is the memory held by the nodes resident in the pool, PoolResident their count.
+	PoolBytes    int64
+	PoolResident int64
 
 	TreeUpdate        int64
 	TreeNewNode       int64
 	TreeDelete        int64
 	PoolDirtyOverflow int64
+
+	DbGet        int64
+	DbSet        int64
+	DbDelete     int64
+	DbReadBytes  int64
+	DbWriteBytes int64
 }
 
 func (m *TreeMetrics) Report() {
-	fmt.Printf("Pool:\n gets: %s, returns: %s, faults: %s, evicts: %s, evict miss %s, dirty overflow: %s\n",
+	fmt.Printf("Pool:\n gets: %s, returns: %s, hits: %s, faults: %s, evicts: %s, evict miss %s, dirty overflow: %s, writeback: %s\n",
 		humanize.Comma(m.PoolGet),
 		humanize.Comma(m.PoolReturn),
+		humanize.Comma(m.PoolHit),
 		humanize.Comma(m.PoolFault),
 		humanize.Comma(m.PoolEvict),
 		humanize.Comma(m.PoolEvictMiss),
-		humanize.Comma(m.PoolDirtyOverflow))
+		humanize.Comma(m.PoolDirtyOverflow),
+		humanize.Comma(m.PoolWriteback))
+	fmt.Printf(" resident: %s nodes, memory: %s\n",
+		humanize.Comma(m.PoolResident),
+		humanize.Bytes(uint64(m.PoolBytes)))
 
 	fmt.Printf("\nTree:\n update: %s, new node: %s, delete: %s\n",
 		humanize.Comma(m.TreeUpdate),
 		humanize.Comma(m.TreeNewNode),
 		humanize.Comma(m.TreeDelete))
+
+	fmt.Printf("\nDB:\n gets: %s, sets: %s, deletes: %s, read: %s, written: %s\n",
+		humanize.Comma(m.DbGet),
+		humanize.Comma(m.DbSet),
+		humanize.Comma(m.DbDelete),
+		humanize.Bytes(uint64(m.DbReadBytes)),
+		humanize.Bytes(uint64(m.DbWriteBytes)))
 }
@@ -0,0 +1,55 @@
+package legacy
+
+import (
+	"errors"
+
+	"github.com/kocubinski/iavlite/proof"
+)
+
+// GetBatchProof returns one proof of the values of keys against the root hash of the last saved version.
+// Keys which are absent are proven so by including the leaves on either side of them.
+func (tree *MutableTree) GetBatchProof(keys [][]byte) (*proof.BatchProof, error) {
+	if err := tree.checkSaved(); err != nil {
+		return nil, err
+	}
+	return proof.NewBatchProof(tree.proofRoot(), keys), nil
+}
+
+// GetRangeProof returns a proof of every key in [start, end) against the root hash of the last saved
+// version, along with the leaves just outside the range which prove that no other keys are in it. A nil
+// start or end leaves that side unbounded.
+func (tree *MutableTree) GetRangeProof(start, end []byte) (*proof.BatchProof, error) {
+	if err := tree.checkSaved(); err != nil {
+		return nil, err
+	}
+	return proof.NewRangeProof(tree.proofRoot(), start, end)
+}
+
+// checkSaved returns an error if the working tree has changes since the last saved version.
+func (tree *MutableTree) checkSaved() error {
+	if tree.dirty {
+		return errors.New("cannot prove keys of a working tree with unsaved changes")
+	}
+	return nil
+}
+
+func (tree *MutableTree) proofRoot() proof.TreeNode {
+	if tree.root == nil {
+		return nil
+	}
+	return proofNode{tree.root}
+}
+
+// proofNode is the proof.TreeNode of a Node.
+type proofNode struct {
+	node *Node
+}
+
+func (n proofNode) Height() int8          { return n.node.subtreeHeight }
+func (n proofNode) Size() int64           { return n.node.size }
+func (n proofNode) Version() int64        { return n.node.nodeKey.version }
+func (n proofNode) Key() []byte           { return n.node.key }
+func (n proofNode) Value() []byte         { return n.node.value }
+func (n proofNode) Hash() []byte          { return n.node.hash }
+func (n proofNode) Left() proof.TreeNode  { return proofNode{n.node.leftNode} }
+func (n proofNode) Right() proof.TreeNode { return proofNode{n.node.rightNode} }
@@ -11,6 +11,9 @@ type MutableTree struct {
 	version int64
 	root    *Node
 	metrics *core.TreeMetrics
+
+	// dirty is set by changes since the last saved version.
+	dirty bool
 }
 
 func (tree *MutableTree) SaveVersion() ([]byte, int64, error) {
@@ -19,6 +22,7 @@ func (tree *MutableTree) SaveVersion() ([]byte, int64, error) {
 		return nil, 0, err
 	}
 	tree.version = version
+	tree.dirty = false
 
 	return tree.root.hash, version, nil
 }
@@ -111,6 +115,7 @@ func (tree *MutableTree) set(key []byte, value []byte) (updated bool, err error)
 		return updated, fmt.Errorf("attempt to store nil value at key '%s'", key)
 	}
 
+	tree.dirty = true
 	if tree.root == nil {
 		tree.root = NewNode(key, value)
 		return updated, nil
@@ -196,6 +201,7 @@ func (tree *MutableTree) Remove(key []byte) ([]byte, bool, error) {
 	tree.metrics.TreeDelete++
 
 	tree.root = newRoot
+	tree.dirty = true
 	return value, true, nil
 }
 
@@ -1,11 +1,16 @@
 package legacy
 
 import (
+	"bytes"
 	"fmt"
+	"math/rand"
+	"sort"
 	"testing"
 
 	"github.com/kocubinski/iavlite/core"
+	"github.com/kocubinski/iavlite/proof"
 	"github.com/kocubinski/iavlite/testutil"
+	"github.com/stretchr/testify/require"
 )
 
 func TestTree_Build(t *testing.T) {
@@ -28,6 +33,89 @@ func TestTree_Build(t *testing.T) {
 	fmt.Printf("treeHeightCounts: %v\n", heightCounts)
 }
 
+func TestTree_GetBatchProof(t *testing.T) {
+	tree := &MutableTree{metrics: &core.TreeMetrics{}}
+	kv := make(map[string][]byte)
+	for j, key := range testutil.BuildRandomTree(t, tree, 20, 50) {
+		kv[string(key)] = []byte(fmt.Sprintf("value-%d-%d", j/50, j%50))
+	}
+
+	r := rand.New(rand.NewSource(4321))
+	var batch [][]byte
+	for key := range kv {
+		if len(batch) == 50 {
+			break
+		}
+		absent := make([]byte, 1+r.Intn(16))
+		r.Read(absent)
+		batch = append(batch, []byte(key), absent)
+	}
+	p, err := tree.GetBatchProof(batch)
+	require.NoError(t, err)
+	root, err := p.Calculate()
+	require.NoError(t, err)
+	require.Equal(t, tree.root.hash, root)
+	for _, key := range batch {
+		value, err := p.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, kv[string(key)], value)
+	}
+
+	start, end := []byte{0x40}, []byte{0x80}
+	p, err = tree.GetRangeProof(start, end)
+	require.NoError(t, err)
+	root, err = p.Calculate()
+	require.NoError(t, err)
+	require.Equal(t, tree.root.hash, root)
+	var expected []proof.KVPair
+	for key, value := range kv {
+		if bytes.Compare([]byte(key), start) >= 0 && bytes.Compare([]byte(key), end) < 0 {
+			expected = append(expected, proof.KVPair{Key: []byte(key), Value: value})
+		}
+	}
+	sort.Slice(expected, func(i, j int) bool {
+		return bytes.Compare(expected[i].Key, expected[j].Key) < 0
+	})
+	pairs, err := p.Range(start, end)
+	require.NoError(t, err)
+	require.Equal(t, expected, pairs)
+	_, err = p.Range(nil, nil)
+	require.Error(t, err)
+
+	_, err = tree.Set([]byte("unsaved"), []byte("value"))
+	require.NoError(t, err)
+	_, err = tree.GetBatchProof(batch)
+	require.Error(t, err)
+}
+
+func TestTree_ProofUnsaved(t *testing.T) {
+	tree := &MutableTree{metrics: &core.TreeMetrics{}}
+	for _, key := range []string{"a", "b"} {
+		_, err := tree.Set([]byte(key), []byte("value"))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	// removing a leaf collapses the root onto its saved sibling.
+	_, removed, err := tree.Remove([]byte("a"))
+	require.NoError(t, err)
+	require.True(t, removed)
+	require.NotNil(t, tree.root.nodeKey)
+	_, err = tree.GetBatchProof([][]byte{[]byte("b")})
+	require.Error(t, err)
+	_, err = tree.GetRangeProof(nil, nil)
+	require.Error(t, err)
+
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	p, err := tree.GetBatchProof([][]byte{[]byte("b")})
+	require.NoError(t, err)
+	root, err := p.Calculate()
+	require.NoError(t, err)
+	require.Equal(t, tree.root.hash, root)
+}
+
 func treeCount(node *Node) int {
 	if node == nil {
 		return 0
@@ -0,0 +1,63 @@
+package memiavl
+
+import "container/list"
+
+// cache is a bounded LRU cache of the values of keys, in front of lookups in the tree.
+type cache struct {
+	size    int
+	entries map[string]*list.Element
+	// lru holds *cacheNode, the most recently used at the front.
+	lru *list.List
+
+	hits, misses int64
+}
+
+type cacheNode struct {
+	key, value []byte
+}
+
+func (n *cacheNode) GetKey() []byte {
+	return n.key
+}
+
+func newCache(size int) *cache {
+	return &cache{
+		size:    size,
+		entries: make(map[string]*list.Element, size),
+		lru:     list.New(),
+	}
+}
+
+// get returns the cached value of key, counting a hit or a miss.
+func (c *cache) get(key []byte) ([]byte, bool) {
+	elem, ok := c.entries[string(key)]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*cacheNode).value, true
+}
+
+// add caches the value of key, evicting the least recently used entry if the cache is full.
+func (c *cache) add(key, value []byte) {
+	if elem, ok := c.entries[string(key)]; ok {
+		elem.Value.(*cacheNode).value = value
+		c.lru.MoveToFront(elem)
+		return
+	}
+	if c.lru.Len() >= c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, string(oldest.Value.(*cacheNode).GetKey()))
+	}
+	c.entries[string(key)] = c.lru.PushFront(&cacheNode{key: key, value: value})
+}
+
+func (c *cache) remove(key []byte) {
+	if elem, ok := c.entries[string(key)]; ok {
+		c.lru.Remove(elem)
+		delete(c.entries, string(key))
+	}
+}
@@ -0,0 +1,121 @@
+package memiavl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/tidwall/wal"
+)
+
+// ChangesetLog is an append-only log of the changesets of a tree, one entry per saved version. Together
+// with a snapshot of an earlier version it is enough to rebuild the tree.
+type ChangesetLog struct {
+	log *wal.Log
+}
+
+// OpenChangesetLog opens or creates the changeset log in dir.
+func OpenChangesetLog(dir string) (*ChangesetLog, error) {
+	log, err := wal.Open(dir, wal.DefaultOptions)
+	if err != nil {
+		return nil, err
+	}
+	return &ChangesetLog{log: log}, nil
+}
+
+// Append writes the changes of version, which resulted in rootHash, to the end of the log.
+func (l *ChangesetLog) Append(version int64, rootHash []byte, changeSet *ChangeSet) error {
+	bz, err := proto.Marshal(&ChangeSetEntry{Version: version, RootHash: rootHash, ChangeSet: changeSet})
+	if err != nil {
+		return err
+	}
+	last, err := l.log.LastIndex()
+	if err != nil {
+		return err
+	}
+	return l.log.Write(last+1, bz)
+}
+
+// Replay applies the logged changesets of the versions after that of tree, checking that each saved
+// version has the logged root hash. A changeset log set on tree is detached meanwhile, so the replayed
+// versions are not logged again.
+func (l *ChangesetLog) Replay(tree *Tree) error {
+	logged := tree.changesetLog
+	tree.changesetLog = nil
+	defer func() { tree.changesetLog = logged }()
+
+	first, err := l.log.FirstIndex()
+	if err != nil {
+		return err
+	}
+	last, err := l.log.LastIndex()
+	if err != nil {
+		return err
+	}
+	if first == 0 {
+		return nil
+	}
+	for index := first; index <= last; index++ {
+		bz, err := l.log.Read(index)
+		if err != nil {
+			return err
+		}
+		entry := &ChangeSetEntry{}
+		if err := proto.Unmarshal(bz, entry); err != nil {
+			return fmt.Errorf("changeset log entry %d, %w", index, err)
+		}
+		if entry.Version <= tree.Version() {
+			continue
+		}
+		// a log which starts after version 1 was written by a tree with an initial version.
+		if tree.Version() == 0 && index == first && entry.Version > 1 {
+			tree.initialVersion = uint32(entry.Version)
+		}
+		if err := tree.ApplyChangeSet(entry.ChangeSet); err != nil {
+			return err
+		}
+		hash, version, err := tree.SaveVersion()
+		if err != nil {
+			return err
+		}
+		if version != entry.Version {
+			return fmt.Errorf("replayed version %d, but the changeset log has version %d", version, entry.Version)
+		}
+		if !bytes.Equal(hash, entry.RootHash) {
+			return fmt.Errorf("root hash %X of replayed version %d does not match logged %X", hash, version,
+				entry.RootHash)
+		}
+	}
+	return nil
+}
+
+// Close closes the log.
+func (l *ChangesetLog) Close() error {
+	return l.log.Close()
+}
+
+// ReplayTree rebuilds a tree from the snapshot file at snapshotPath, if there is one, and the changesets
+// logged after it. The log is then set on the tree, so that the versions it saves are logged in turn. The
+// returned snapshot is nil if there was no file, and otherwise must stay open while the tree is in use.
+func ReplayTree(snapshotPath string, log *ChangesetLog, cacheSize int) (*Tree, *Snapshot, error) {
+	snapshot, err := OpenSnapshot(snapshotPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, err
+	}
+	var tree *Tree
+	if snapshot != nil {
+		tree = NewFromSnapshot(snapshot, cacheSize)
+	} else {
+		tree = NewEmptyTree(0, 0, cacheSize)
+	}
+	if err := log.Replay(tree); err != nil {
+		if snapshot != nil {
+			snapshot.Close()
+		}
+		return nil, nil, err
+	}
+	tree.SetChangesetLog(log)
+	return tree, snapshot, nil
+}
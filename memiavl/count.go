@@ -0,0 +1,51 @@
+package memiavl
+
+// CountRange returns the number of keys in [start, end), from the sizes of the subtrees on the paths to
+// start and end. A nil start or end leaves that side unbounded.
+func (t *Tree) CountRange(start, end []byte) int64 {
+	if t.root == nil {
+		return 0
+	}
+	from, to := int64(0), t.root.Size()
+	if start != nil {
+		from, _ = t.GetWithIndex(start)
+	}
+	if end != nil {
+		to, _ = t.GetWithIndex(end)
+	}
+	if to < from {
+		return 0
+	}
+	return to - from
+}
+
+// CountPrefix returns the number of keys starting with prefix.
+func (t *Tree) CountPrefix(prefix []byte) int64 {
+	if len(prefix) == 0 {
+		return t.CountRange(nil, nil)
+	}
+	return t.CountRange(prefix, prefixEnd(prefix))
+}
+
+// KeyAtRank returns the key with rank keys before it, or nil if rank is out of range.
+func (t *Tree) KeyAtRank(rank int64) []byte {
+	if rank < 0 {
+		return nil
+	}
+	key, _ := t.GetByIndex(rank)
+	return key
+}
+
+// prefixEnd returns the least key greater than all the keys starting with prefix, or nil if there is
+// none because prefix is all 0xff.
+func prefixEnd(prefix []byte) []byte {
+	end := make([]byte, len(prefix))
+	copy(end, prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
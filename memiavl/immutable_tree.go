@@ -0,0 +1,100 @@
+package memiavl
+
+import "github.com/kocubinski/iavlite/proof"
+
+// ImmutableTree is a read-only view of a Tree returned by Tree.Snapshot. It shares its nodes with the
+// tree, which clones rather than mutates them, so it stays consistent and may be read concurrently with
+// writes to the tree.
+type ImmutableTree struct {
+	tree Tree
+}
+
+// Snapshot returns an immutable view of the tree as it is now, including changes not saved yet. Nodes
+// reachable from it are copied on write from then on.
+func (t *Tree) Snapshot() *ImmutableTree {
+	// hashes are cached in the nodes on demand, compute them now so that reads of the view never write
+	// to the nodes it shares.
+	t.RootHash()
+
+	// nodes of the working version are only shared if the tree has unsaved changes, which have all
+	// mutated the root.
+	cowVersion := t.version
+	if t.root != nil && t.root.Version() > t.version {
+		cowVersion = t.root.Version()
+	}
+	if cowVersion > t.cowVersion {
+		t.cowVersion = cowVersion
+	}
+
+	return &ImmutableTree{tree: Tree{
+		version:        t.version,
+		root:           t.root,
+		initialVersion: t.initialVersion,
+		cowVersion:     t.cowVersion,
+		dirty:          t.dirty,
+	}}
+}
+
+func (it *ImmutableTree) Version() int64 {
+	return it.tree.Version()
+}
+
+func (it *ImmutableTree) RootHash() []byte {
+	return it.tree.RootHash()
+}
+
+func (it *ImmutableTree) Get(key []byte) []byte {
+	return it.tree.Get(key)
+}
+
+func (it *ImmutableTree) Has(key []byte) bool {
+	return it.tree.Has(key)
+}
+
+func (it *ImmutableTree) GetWithIndex(key []byte) (int64, []byte) {
+	return it.tree.GetWithIndex(key)
+}
+
+func (it *ImmutableTree) GetByIndex(index int64) ([]byte, []byte) {
+	return it.tree.GetByIndex(index)
+}
+
+func (it *ImmutableTree) Size() int64 {
+	return it.tree.Size()
+}
+
+func (it *ImmutableTree) Height() int8 {
+	return it.tree.Height()
+}
+
+func (it *ImmutableTree) GetMembershipProof(key []byte) (*proof.ExistenceProof, error) {
+	return it.tree.GetMembershipProof(key)
+}
+
+func (it *ImmutableTree) GetNonMembershipProof(key []byte) (*proof.NonExistenceProof, error) {
+	return it.tree.GetNonMembershipProof(key)
+}
+
+func (it *ImmutableTree) GetBatchProof(keys [][]byte) (*proof.BatchProof, error) {
+	return it.tree.GetBatchProof(keys)
+}
+
+func (it *ImmutableTree) GetRangeProof(start, end []byte) (*proof.BatchProof, error) {
+	return it.tree.GetRangeProof(start, end)
+}
+
+func (it *ImmutableTree) Iterator(start, end []byte, ascending bool) (*Iterator, error) {
+	return it.tree.Iterator(start, end, ascending)
+}
+
+func (it *ImmutableTree) CountRange(start, end []byte) int64 {
+	return it.tree.CountRange(start, end)
+}
+
+func (it *ImmutableTree) CountPrefix(prefix []byte) int64 {
+	return it.tree.CountPrefix(prefix)
+}
+
+func (it *ImmutableTree) KeyAtRank(rank int64) []byte {
+	return it.tree.KeyAtRank(rank)
+}
@@ -0,0 +1,141 @@
+package memiavl
+
+import (
+	"bytes"
+	"errors"
+
+	dbm "github.com/cosmos/cosmos-db"
+)
+
+var _ dbm.Iterator = (*Iterator)(nil)
+
+// Iterator walks the leaves of a tree in key order over the domain [start, end). The tree must not be
+// mutated while an Iterator is open, iterate over a Snapshot for that.
+type Iterator struct {
+	start, end []byte
+	ascending  bool
+
+	// stack holds the nodes which are yet to be visited.
+	stack []Node
+	key   []byte
+	value []byte
+	valid bool
+}
+
+// Iterator returns an iterator over the domain [start, end) of the tree. A nil start or end leaves that
+// side of the domain unbounded.
+func (t *Tree) Iterator(start, end []byte, ascending bool) (*Iterator, error) {
+	if (start != nil && len(start) == 0) || (end != nil && len(end) == 0) {
+		return nil, errors.New("iterator key is empty")
+	}
+	itr := &Iterator{
+		start:     start,
+		end:       end,
+		ascending: ascending,
+		valid:     true,
+	}
+	if t.root != nil {
+		itr.stack = append(itr.stack, t.root)
+	}
+	itr.Next()
+	return itr, nil
+}
+
+func (itr *Iterator) Domain() (start []byte, end []byte) {
+	return itr.start, itr.end
+}
+
+func (itr *Iterator) Valid() bool {
+	return itr.valid
+}
+
+// Next advances to the next leaf in the domain.
+func (itr *Iterator) Next() {
+	for len(itr.stack) > 0 {
+		node := itr.stack[len(itr.stack)-1]
+		itr.stack = itr.stack[:len(itr.stack)-1]
+
+		if node.IsLeaf() {
+			key := node.Key()
+			if itr.ascending && itr.end != nil && bytes.Compare(key, itr.end) >= 0 {
+				break
+			}
+			if !itr.ascending && itr.start != nil && bytes.Compare(key, itr.start) < 0 {
+				break
+			}
+			if itr.inDomain(key) {
+				itr.key = key
+				itr.value = node.Value()
+				return
+			}
+			continue
+		}
+
+		itr.pushChildren(node)
+	}
+
+	itr.valid = false
+	itr.key = nil
+	itr.value = nil
+	itr.stack = nil
+}
+
+// pushChildren pushes the children of node which may hold keys in the domain onto the stack, ordered
+// so that the next leaf in iteration order is popped first.
+func (itr *Iterator) pushChildren(node Node) {
+	// node.Key() is the smallest key in the right subtree.
+	key := node.Key()
+	visitLeft := itr.start == nil || bytes.Compare(itr.start, key) < 0
+	visitRight := itr.end == nil || bytes.Compare(key, itr.end) < 0
+
+	if itr.ascending {
+		if visitRight {
+			itr.stack = append(itr.stack, node.Right())
+		}
+		if visitLeft {
+			itr.stack = append(itr.stack, node.Left())
+		}
+	} else {
+		if visitLeft {
+			itr.stack = append(itr.stack, node.Left())
+		}
+		if visitRight {
+			itr.stack = append(itr.stack, node.Right())
+		}
+	}
+}
+
+func (itr *Iterator) inDomain(key []byte) bool {
+	if itr.start != nil && bytes.Compare(key, itr.start) < 0 {
+		return false
+	}
+	if itr.end != nil && bytes.Compare(key, itr.end) >= 0 {
+		return false
+	}
+	return true
+}
+
+func (itr *Iterator) Key() (key []byte) {
+	if !itr.valid {
+		panic("iterator is invalid")
+	}
+	return itr.key
+}
+
+func (itr *Iterator) Value() (value []byte) {
+	if !itr.valid {
+		panic("iterator is invalid")
+	}
+	return itr.value
+}
+
+// Error always returns nil, since the nodes of a tree are all in memory or mapped.
+func (itr *Iterator) Error() error {
+	return nil
+}
+
+func (itr *Iterator) Close() error {
+	itr.valid = false
+	itr.stack = nil
+	return nil
+}
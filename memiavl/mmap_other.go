@@ -0,0 +1,21 @@
+//go:build !unix
+
+package memiavl
+
+import (
+	"io"
+	"os"
+)
+
+// mmapFile reads the file into memory where mmap is not available.
+func mmapFile(f *os.File, size int) ([]byte, error) {
+	data := make([]byte, size)
+	if _, err := io.ReadFull(f, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func munmap([]byte) error {
+	return nil
+}
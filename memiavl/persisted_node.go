@@ -0,0 +1,159 @@
+package memiavl
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// PersistedNode is a node read in place from a memory-mapped Snapshot. index is into the leaves of the
+// snapshot if isLeaf, otherwise into its inner nodes.
+type PersistedNode struct {
+	snapshot *Snapshot
+	index    uint32
+	isLeaf   bool
+}
+
+var _ Node = PersistedNode{}
+
+func (node PersistedNode) leafRecord() []byte {
+	offset := int(node.index) * sizeLeaf
+	return node.snapshot.leaves[offset : offset+sizeLeaf]
+}
+
+func (node PersistedNode) nodeRecord() []byte {
+	offset := int(node.index) * sizeNode
+	return node.snapshot.nodes[offset : offset+sizeNode]
+}
+
+func (node PersistedNode) Height() uint8 {
+	if node.isLeaf {
+		return 0
+	}
+	return node.nodeRecord()[0]
+}
+
+func (node PersistedNode) IsLeaf() bool {
+	return node.isLeaf
+}
+
+func (node PersistedNode) Size() int64 {
+	if node.isLeaf {
+		return 1
+	}
+	return int64(binary.LittleEndian.Uint64(node.nodeRecord()[8:]))
+}
+
+func (node PersistedNode) Version() uint32 {
+	if node.isLeaf {
+		return binary.LittleEndian.Uint32(node.leafRecord())
+	}
+	return binary.LittleEndian.Uint32(node.nodeRecord()[4:])
+}
+
+func (node PersistedNode) Key() []byte {
+	if node.isLeaf {
+		key, _ := node.snapshot.leafKeyValue(node.index)
+		return key
+	}
+	key, _ := node.snapshot.leafKeyValue(binary.LittleEndian.Uint32(node.nodeRecord()[16:]))
+	return key
+}
+
+func (node PersistedNode) Value() []byte {
+	if !node.isLeaf {
+		return nil
+	}
+	_, value := node.snapshot.leafKeyValue(node.index)
+	return value
+}
+
+func (node PersistedNode) Left() Node {
+	if node.isLeaf {
+		return nil
+	}
+	return node.snapshot.ref(binary.LittleEndian.Uint32(node.nodeRecord()[20:]))
+}
+
+func (node PersistedNode) Right() Node {
+	if node.isLeaf {
+		return nil
+	}
+	return node.snapshot.ref(binary.LittleEndian.Uint32(node.nodeRecord()[24:]))
+}
+
+func (node PersistedNode) Hash() []byte {
+	if node.isLeaf {
+		return node.leafRecord()[24:sizeLeaf:sizeLeaf]
+	}
+	return node.nodeRecord()[32:sizeNode:sizeNode]
+}
+
+// Mutate always clones the node into a MemNode, since the snapshot is read-only.
+func (node PersistedNode) Mutate(version, _ uint32) *MemNode {
+	mnode := &MemNode{
+		height:  node.Height(),
+		size:    node.Size(),
+		version: version,
+		key:     node.Key(),
+	}
+	if node.isLeaf {
+		mnode.value = node.Value()
+	} else {
+		mnode.left = node.Left()
+		mnode.right = node.Right()
+	}
+	return mnode
+}
+
+func (node PersistedNode) Get(key []byte) ([]byte, uint32) {
+	if node.isLeaf {
+		nodeKey, value := node.snapshot.leafKeyValue(node.index)
+		switch bytes.Compare(nodeKey, key) {
+		case -1:
+			return nil, 1
+		case 1:
+			return nil, 0
+		default:
+			return value, 0
+		}
+	}
+
+	if bytes.Compare(key, node.Key()) == -1 {
+		return node.Left().Get(key)
+	}
+	right := node.Right()
+	value, index := right.Get(key)
+	return value, index + uint32(node.Size()) - uint32(right.Size())
+}
+
+// GetByIndex reads the leaf directly, since the leaves of a snapshot are stored in key order.
+func (node PersistedNode) GetByIndex(index uint32) ([]byte, []byte) {
+	if index >= uint32(node.Size()) {
+		return nil, nil
+	}
+	first := node.index
+	if !node.isLeaf {
+		first = node.firstLeaf()
+	}
+	return node.snapshot.leafKeyValue(first + index)
+}
+
+// firstLeaf returns the index of the first leaf under an inner node, the one left of its key leaf by the
+// size of its left subtree.
+func (node PersistedNode) firstLeaf() uint32 {
+	keyLeaf := binary.LittleEndian.Uint32(node.nodeRecord()[16:])
+	return keyLeaf - uint32(node.Left().Size())
+}
+
+// leafKeyValue returns the key and value of the leaf at index, as slices of the mapping.
+func (s *Snapshot) leafKeyValue(index uint32) ([]byte, []byte) {
+	offset := int(index) * sizeLeaf
+	record := s.leaves[offset : offset+sizeLeaf]
+	keyLen := binary.LittleEndian.Uint32(record[4:])
+	valueLen := binary.LittleEndian.Uint32(record[8:])
+	kvOffset := binary.LittleEndian.Uint64(record[16:])
+	valueOffset := kvOffset + uint64(keyLen)
+	end := valueOffset + uint64(valueLen)
+	// the capacities are capped so that appending to a key or value can't write into the mapping.
+	return s.kvs[kvOffset:valueOffset:valueOffset], s.kvs[valueOffset:end:end]
+}
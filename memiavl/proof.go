@@ -0,0 +1,131 @@
+package memiavl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/kocubinski/iavlite/proof"
+)
+
+// GetMembershipProof returns an ICS23 existence proof of key against the root hash of the last saved
+// version.
+func (t *Tree) GetMembershipProof(key []byte) (*proof.ExistenceProof, error) {
+	if err := t.checkSaved(); err != nil {
+		return nil, err
+	}
+	if t.root == nil {
+		return nil, fmt.Errorf("cannot prove key %X in an empty tree", key)
+	}
+	return createExistenceProof(t.root, key)
+}
+
+// GetNonMembershipProof returns an ICS23 non-existence proof of key against the root hash of the last
+// saved version, made of existence proofs of the leaves on either side of where key would be.
+func (t *Tree) GetNonMembershipProof(key []byte) (*proof.NonExistenceProof, error) {
+	if err := t.checkSaved(); err != nil {
+		return nil, err
+	}
+	p := &proof.NonExistenceProof{Key: key}
+	if t.root == nil {
+		return p, nil
+	}
+	index, value := t.GetWithIndex(key)
+	if value != nil {
+		return nil, fmt.Errorf("cannot prove absence of key %X which is in the tree", key)
+	}
+
+	// index is the number of keys less than key.
+	var err error
+	if index > 0 {
+		left, _ := t.GetByIndex(index - 1)
+		if p.Left, err = createExistenceProof(t.root, left); err != nil {
+			return nil, err
+		}
+	}
+	if index < t.root.Size() {
+		right, _ := t.GetByIndex(index)
+		if p.Right, err = createExistenceProof(t.root, right); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// createExistenceProof walks from root to the leaf of key, recording the sibling of each node on the way
+// down. The path of the proof runs the other way, from the leaf up.
+func createExistenceProof(root Node, key []byte) (*proof.ExistenceProof, error) {
+	var path []*proof.InnerOp
+	node := root
+	for !node.IsLeaf() {
+		var op *proof.InnerOp
+		if bytes.Compare(key, node.Key()) < 0 {
+			op = innerOp(node, node.Right().Hash(), true)
+			node = node.Left()
+		} else {
+			op = innerOp(node, node.Left().Hash(), false)
+			node = node.Right()
+		}
+		path = append(path, op)
+	}
+	if !bytes.Equal(node.Key(), key) {
+		return nil, fmt.Errorf("key %X not found", key)
+	}
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return &proof.ExistenceProof{
+		Key:   node.Key(),
+		Value: node.Value(),
+		Leaf:  proof.IavlLeafOp(int64(node.Version())),
+		Path:  path,
+	}, nil
+}
+
+func innerOp(node Node, sibling []byte, pathLeft bool) *proof.InnerOp {
+	return proof.IavlInnerOp(int8(node.Height()), node.Size(), int64(node.Version()), sibling, pathLeft)
+}
+
+// GetBatchProof returns one proof of the values of keys against the root hash of the last saved version.
+// Keys which are absent are proven so by including the leaves on either side of them.
+func (t *Tree) GetBatchProof(keys [][]byte) (*proof.BatchProof, error) {
+	if err := t.checkSaved(); err != nil {
+		return nil, err
+	}
+	return proof.NewBatchProof(t.proofRoot(), keys), nil
+}
+
+// GetRangeProof returns a proof of every key in [start, end) against the root hash of the last saved
+// version, along with the leaves just outside the range which prove that no other keys are in it. A nil
+// start or end leaves that side unbounded.
+func (t *Tree) GetRangeProof(start, end []byte) (*proof.BatchProof, error) {
+	if err := t.checkSaved(); err != nil {
+		return nil, err
+	}
+	return proof.NewRangeProof(t.proofRoot(), start, end)
+}
+
+// checkSaved returns an error if the tree has changes since the last saved version.
+func (t *Tree) checkSaved() error {
+	if t.dirty {
+		return errors.New("cannot prove keys of a working tree with unsaved changes")
+	}
+	return nil
+}
+
+func (t *Tree) proofRoot() proof.TreeNode {
+	if t.root == nil {
+		return nil
+	}
+	return proofNode{t.root}
+}
+
+// proofNode is the proof.TreeNode of a Node.
+type proofNode struct {
+	Node
+}
+
+func (n proofNode) Height() int8          { return int8(n.Node.Height()) }
+func (n proofNode) Version() int64        { return int64(n.Node.Version()) }
+func (n proofNode) Left() proof.TreeNode  { return proofNode{n.Node.Left()} }
+func (n proofNode) Right() proof.TreeNode { return proofNode{n.Node.Right()} }
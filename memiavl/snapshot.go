@@ -0,0 +1,344 @@
+package memiavl
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// A snapshot file holds a tree in three flat sections after a fixed header:
+//
+//	header | leaves | nodes | kvs
+//
+// Leaves and inner nodes are fixed size records in post-order, so that the last node is the root. Keys
+// and values of the leaves are concatenated in the kvs section. Integers are little endian.
+const (
+	snapshotMagic         = "IAVLSNAP"
+	snapshotFormatVersion = 1
+
+	// header: magic, format version, tree version, leaf count, node count, kvs size.
+	snapshotHeaderSize = 8 + 4 + 4 + 4 + 4 + 8
+
+	// leaf: version, key length, value length, padding, kv offset, hash.
+	sizeLeaf = 4 + 4 + 4 + 4 + 8 + 32
+	// node: height, padding, version, size, key leaf, left, right, padding, hash. The key of an inner node
+	// is the key of the first leaf of its right subtree.
+	sizeNode = 1 + 3 + 4 + 8 + 4 + 4 + 4 + 4 + 32
+
+	// leafRef marks a child reference as a leaf index rather than a node index.
+	leafRef = uint32(1) << 31
+)
+
+// Snapshot is a read-only tree memory-mapped from a snapshot file. Nodes read from it refer to the
+// mapping, so it must stay open while any tree built on it is in use.
+type Snapshot struct {
+	data    []byte
+	version uint32
+
+	leaves, nodes, kvs   []byte
+	leafCount, nodeCount uint32
+}
+
+// WriteSnapshot writes the tree at its current version to a snapshot file at path. The file is written
+// under a temporary name and renamed once complete.
+func (t *Tree) WriteSnapshot(path string) (err error) {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+		}
+	}()
+
+	var leafCount, nodeCount uint32
+	if t.root != nil {
+		if t.root.Size() >= int64(leafRef) {
+			return fmt.Errorf("tree of %d leaves is too large for a snapshot", t.root.Size())
+		}
+		leafCount = uint32(t.root.Size())
+		nodeCount = leafCount - 1
+		// hashes are computed on demand, compute them all before the scan.
+		t.root.Hash()
+	}
+	nodesOffset := snapshotHeaderSize + int64(leafCount)*sizeLeaf
+	kvsOffset := nodesOffset + int64(nodeCount)*sizeNode
+	w := &snapshotWriter{
+		leaves: bufio.NewWriter(io.NewOffsetWriter(f, snapshotHeaderSize)),
+		nodes:  bufio.NewWriter(io.NewOffsetWriter(f, nodesOffset)),
+		kvs:    bufio.NewWriter(io.NewOffsetWriter(f, kvsOffset)),
+	}
+	t.ScanPostOrder(func(node Node) bool {
+		w.err = w.write(node)
+		return w.err == nil
+	})
+	if w.err != nil {
+		return w.err
+	}
+	for _, bw := range []*bufio.Writer{w.leaves, w.nodes, w.kvs} {
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+	}
+
+	header := make([]byte, snapshotHeaderSize)
+	copy(header, snapshotMagic)
+	binary.LittleEndian.PutUint32(header[8:], snapshotFormatVersion)
+	binary.LittleEndian.PutUint32(header[12:], t.version)
+	binary.LittleEndian.PutUint32(header[16:], leafCount)
+	binary.LittleEndian.PutUint32(header[20:], nodeCount)
+	binary.LittleEndian.PutUint64(header[24:], w.kvSize)
+	if _, err := f.WriteAt(header, 0); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// snapshotWriter appends the nodes of a post-order scan to the sections of a snapshot. stack holds the
+// references of the subtrees written whose parent is not yet.
+type snapshotWriter struct {
+	leaves, nodes, kvs *bufio.Writer
+	leafCount          uint32
+	nodeCount          uint32
+	kvSize             uint64
+	stack              []subtreeRef
+	err                error
+}
+
+type subtreeRef struct {
+	ref       uint32
+	firstLeaf uint32
+	firstKey  []byte
+}
+
+func (w *snapshotWriter) write(node Node) error {
+	if node.IsLeaf() {
+		var buf [sizeLeaf]byte
+		binary.LittleEndian.PutUint32(buf[0:], node.Version())
+		binary.LittleEndian.PutUint32(buf[4:], uint32(len(node.Key())))
+		binary.LittleEndian.PutUint32(buf[8:], uint32(len(node.Value())))
+		binary.LittleEndian.PutUint64(buf[16:], w.kvSize)
+		copy(buf[24:], node.Hash())
+		if _, err := w.leaves.Write(buf[:]); err != nil {
+			return err
+		}
+		if _, err := w.kvs.Write(node.Key()); err != nil {
+			return err
+		}
+		if _, err := w.kvs.Write(node.Value()); err != nil {
+			return err
+		}
+		w.kvSize += uint64(len(node.Key()) + len(node.Value()))
+		w.stack = append(w.stack, subtreeRef{ref: w.leafCount | leafRef, firstLeaf: w.leafCount, firstKey: node.Key()})
+		w.leafCount++
+		return nil
+	}
+
+	if len(w.stack) < 2 {
+		return errors.New("inner node without children in post-order scan")
+	}
+	left, right := w.stack[len(w.stack)-2], w.stack[len(w.stack)-1]
+	w.stack = w.stack[:len(w.stack)-2]
+	if !bytes.Equal(node.Key(), right.firstKey) {
+		return fmt.Errorf("inner node key %X is not the first key of its right subtree", node.Key())
+	}
+	var buf [sizeNode]byte
+	buf[0] = node.Height()
+	binary.LittleEndian.PutUint32(buf[4:], node.Version())
+	binary.LittleEndian.PutUint64(buf[8:], uint64(node.Size()))
+	binary.LittleEndian.PutUint32(buf[16:], right.firstLeaf)
+	binary.LittleEndian.PutUint32(buf[20:], left.ref)
+	binary.LittleEndian.PutUint32(buf[24:], right.ref)
+	copy(buf[32:], node.Hash())
+	if _, err := w.nodes.Write(buf[:]); err != nil {
+		return err
+	}
+	w.stack = append(w.stack, subtreeRef{ref: w.nodeCount, firstLeaf: left.firstLeaf, firstKey: left.firstKey})
+	w.nodeCount++
+	return nil
+}
+
+// OpenSnapshot memory-maps the snapshot file at path.
+func OpenSnapshot(path string) (*Snapshot, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < snapshotHeaderSize {
+		return nil, fmt.Errorf("snapshot %s is too short", path)
+	}
+	data, err := mmapFile(f, int(info.Size()))
+	if err != nil {
+		return nil, fmt.Errorf("mapping snapshot %s, %w", path, err)
+	}
+	s, err := newSnapshot(data)
+	if err != nil {
+		munmap(data)
+		return nil, fmt.Errorf("snapshot %s, %w", path, err)
+	}
+	return s, nil
+}
+
+func newSnapshot(data []byte) (*Snapshot, error) {
+	if !bytes.Equal(data[:8], []byte(snapshotMagic)) {
+		return nil, errors.New("not a snapshot file")
+	}
+	if v := binary.LittleEndian.Uint32(data[8:]); v != snapshotFormatVersion {
+		return nil, fmt.Errorf("unsupported format version %d", v)
+	}
+	s := &Snapshot{
+		data:      data,
+		version:   binary.LittleEndian.Uint32(data[12:]),
+		leafCount: binary.LittleEndian.Uint32(data[16:]),
+		nodeCount: binary.LittleEndian.Uint32(data[20:]),
+	}
+	kvSize := binary.LittleEndian.Uint64(data[24:])
+	if s.leafCount >= leafRef || (s.leafCount > 0 && s.nodeCount != s.leafCount-1) || (s.leafCount == 0 && s.nodeCount != 0) {
+		return nil, fmt.Errorf("invalid leaf and node counts %d, %d", s.leafCount, s.nodeCount)
+	}
+	nodesOffset := snapshotHeaderSize + uint64(s.leafCount)*sizeLeaf
+	kvsOffset := nodesOffset + uint64(s.nodeCount)*sizeNode
+	if kvsOffset+kvSize != uint64(len(data)) {
+		return nil, fmt.Errorf("file size %d does not match its sections", len(data))
+	}
+	s.leaves = data[snapshotHeaderSize:nodesOffset]
+	s.nodes = data[nodesOffset:kvsOffset]
+	s.kvs = data[kvsOffset:]
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// validate checks that the kv ranges of the leaves tile the kvs section and that the inner nodes form a
+// tree over the leaves, so that reading nodes never goes out of bounds of the mapping.
+func (s *Snapshot) validate() error {
+	var kvOffset uint64
+	for i := uint32(0); i < s.leafCount; i++ {
+		record := s.leaves[int(i)*sizeLeaf:]
+		if offset := binary.LittleEndian.Uint64(record[16:]); offset != kvOffset {
+			return fmt.Errorf("leaf %d has kv offset %d, expected %d", i, offset, kvOffset)
+		}
+		kvOffset += uint64(binary.LittleEndian.Uint32(record[4:])) + uint64(binary.LittleEndian.Uint32(record[8:]))
+		if kvOffset > uint64(len(s.kvs)) {
+			return fmt.Errorf("leaf %d overruns the kvs section", i)
+		}
+	}
+	if kvOffset != uint64(len(s.kvs)) {
+		return fmt.Errorf("leaves cover %d of %d kv bytes", kvOffset, len(s.kvs))
+	}
+
+	// the first leaf under each node, checked in post-order so that children come before their parents.
+	firstLeaves := make([]uint32, s.nodeCount)
+	// subtree returns the height, size and first leaf of the child ref of node i.
+	subtree := func(i, ref uint32) (uint8, uint64, uint32, error) {
+		if ref&leafRef != 0 {
+			if index := ref &^ leafRef; index < s.leafCount {
+				return 0, 1, index, nil
+			}
+		} else if ref < i {
+			record := s.nodes[int(ref)*sizeNode:]
+			return record[0], binary.LittleEndian.Uint64(record[8:]), firstLeaves[ref], nil
+		}
+		return 0, 0, 0, fmt.Errorf("node %d has invalid child ref %d", i, ref)
+	}
+	for i := uint32(0); i < s.nodeCount; i++ {
+		record := s.nodes[int(i)*sizeNode:]
+		leftHeight, leftSize, leftFirst, err := subtree(i, binary.LittleEndian.Uint32(record[20:]))
+		if err != nil {
+			return err
+		}
+		rightHeight, rightSize, rightFirst, err := subtree(i, binary.LittleEndian.Uint32(record[24:]))
+		if err != nil {
+			return err
+		}
+		if leftFirst+uint32(leftSize) != rightFirst {
+			return fmt.Errorf("children of node %d are not adjacent", i)
+		}
+		if keyLeaf := binary.LittleEndian.Uint32(record[16:]); keyLeaf != rightFirst {
+			return fmt.Errorf("node %d has key leaf %d, expected %d", i, keyLeaf, rightFirst)
+		}
+		if size := binary.LittleEndian.Uint64(record[8:]); size != leftSize+rightSize {
+			return fmt.Errorf("node %d has size %d, expected %d", i, size, leftSize+rightSize)
+		}
+		if leftHeight < rightHeight {
+			leftHeight = rightHeight
+		}
+		if height := record[0]; height != leftHeight+1 {
+			return fmt.Errorf("node %d has height %d, expected %d", i, height, leftHeight+1)
+		}
+		firstLeaves[i] = leftFirst
+	}
+	if s.nodeCount > 0 {
+		root := s.nodes[int(s.nodeCount-1)*sizeNode:]
+		if firstLeaves[s.nodeCount-1] != 0 || binary.LittleEndian.Uint64(root[8:]) != uint64(s.leafCount) {
+			return errors.New("root does not cover every leaf")
+		}
+	}
+	return nil
+}
+
+// Close unmaps the snapshot. Nodes read from it must not be used afterwards.
+func (s *Snapshot) Close() error {
+	data := s.data
+	s.data, s.leaves, s.nodes, s.kvs = nil, nil, nil, nil
+	return munmap(data)
+}
+
+// Version returns the version of the tree in the snapshot.
+func (s *Snapshot) Version() uint32 {
+	return s.version
+}
+
+// RootNode returns the root of the tree in the snapshot, or nil if it is empty.
+func (s *Snapshot) RootNode() Node {
+	switch {
+	case s.nodeCount > 0:
+		return s.node(s.nodeCount - 1)
+	case s.leafCount > 0:
+		return s.leaf(0)
+	default:
+		return nil
+	}
+}
+
+func (s *Snapshot) node(index uint32) PersistedNode {
+	return PersistedNode{snapshot: s, index: index}
+}
+
+func (s *Snapshot) leaf(index uint32) PersistedNode {
+	return PersistedNode{snapshot: s, index: index, isLeaf: true}
+}
+
+func (s *Snapshot) ref(ref uint32) PersistedNode {
+	if ref&leafRef != 0 {
+		return s.leaf(ref &^ leafRef)
+	}
+	return s.node(ref)
+}
+
+// NewFromSnapshot returns a tree whose root is that of the snapshot. Nodes are read from the snapshot as
+// they are reached and cloned into MemNodes when mutated.
+func NewFromSnapshot(snapshot *Snapshot, cacheSize int) *Tree {
+	tree := NewEmptyTree(uint64(snapshot.Version()), 0, cacheSize)
+	tree.root = snapshot.RootNode()
+	return tree
+}
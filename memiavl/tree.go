@@ -1,6 +1,7 @@
 package memiavl
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"errors"
 	"math"
@@ -15,57 +16,119 @@ type Tree struct {
 	root Node
 
 	initialVersion, cowVersion uint32
-}
 
-type cacheNode struct {
-	key, value []byte
-}
+	// dirty is set by changes since the last saved version.
+	dirty bool
 
-func (n *cacheNode) GetKey() []byte {
-	return n.key
+	// changes since the last saved version, kept only while changesetLog is set.
+	changesetLog *ChangesetLog
+	changeSet    ChangeSet
+
+	// cache of the values of keys for Get, nil if disabled.
+	cache *cache
 }
 
-// NewEmptyTree creates an empty tree at an arbitrary version.
+// NewEmptyTree creates an empty tree at an arbitrary version. Up to cacheSize values are cached in
+// front of Get, a cacheSize of zero disables the cache. Get and Has update the cache, so with a cache
+// they must not be called concurrently; concurrent readers should use a Snapshot, which has none.
 func NewEmptyTree(version uint64, initialVersion uint32, cacheSize int) *Tree {
 	if version >= math.MaxUint32 {
 		panic("version overflows uint32")
 	}
 
-	return &Tree{
+	tree := &Tree{
 		version:        uint32(version),
 		initialVersion: initialVersion,
 	}
+	if cacheSize > 0 {
+		tree.cache = newCache(cacheSize)
+	}
+	return tree
 }
 
+// Set sets key to value in the working tree. The given key and value byte slices must not be modified
+// after this call, since they are stored in the tree, the changeset and the cache.
 func (t *Tree) Set(key, value []byte) (updated bool, err error) {
 	if value == nil {
 		// the value could be nil when replaying changes from write-ahead-log because of protobuf decoding
 		value = []byte{}
 	}
 	t.root, updated = setRecursive(t.root, key, value, t.version+1, t.cowVersion)
+	t.dirty = true
+	if t.changesetLog != nil {
+		t.changeSet.Pairs = append(t.changeSet.Pairs, &KVPair{Key: key, Value: value})
+	}
+	if t.cache != nil {
+		t.cache.add(key, value)
+	}
 	return updated, nil
 }
 
 func (t *Tree) Remove(key []byte) ([]byte, bool, error) {
 	var v []byte
 	v, t.root, _ = removeRecursive(t.root, key, t.version+1, t.cowVersion)
+	if v != nil {
+		t.dirty = true
+	}
+	if v != nil && t.changesetLog != nil {
+		t.changeSet.Pairs = append(t.changeSet.Pairs, &KVPair{Delete: true, Key: key})
+	}
+	if t.cache != nil {
+		t.cache.remove(key)
+	}
 	return v, v != nil, nil
 }
 
-// saveVersion increases the version number and optionally updates the hashes
+// ApplyChangeSet sets or removes each of the pairs of changeSet in order.
+func (t *Tree) ApplyChangeSet(changeSet *ChangeSet) error {
+	if changeSet == nil {
+		return nil
+	}
+	for _, pair := range changeSet.Pairs {
+		var err error
+		if pair.Delete {
+			_, _, err = t.Remove(pair.Key)
+		} else {
+			_, err = t.Set(pair.Key, pair.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetChangesetLog makes SaveVersion append the changes of each version to log. Changes made before it is
+// set are not logged, so it should be set right after the tree is loaded or saved.
+func (t *Tree) SetChangesetLog(log *ChangesetLog) {
+	t.changesetLog = log
+	t.changeSet = ChangeSet{}
+}
+
+// saveVersion increases the version number and optionally updates the hashes, and appends the changes
+// of the version to the changeset log if one is set.
 func (t *Tree) SaveVersion() ([]byte, int64, error) {
 	hash := t.RootHash()
 
 	if t.version >= uint32(math.MaxUint32) {
 		return nil, 0, errors.New("version overflows uint32")
 	}
-	t.version++
+	version := t.version + 1
 
 	// to be compatible with existing golang iavl implementation.
 	// see: https://github.com/cosmos/iavl/pull/660
-	if t.version == 1 && t.initialVersion > 0 {
-		t.version = t.initialVersion
+	if version == 1 && t.initialVersion > 0 {
+		version = t.initialVersion
+	}
+
+	if t.changesetLog != nil {
+		if err := t.changesetLog.Append(int64(version), hash, &t.changeSet); err != nil {
+			return nil, 0, err
+		}
+		t.changeSet = ChangeSet{}
 	}
+	t.version = version
+	t.dirty = false
 
 	return hash, int64(t.version), nil
 }
@@ -107,14 +170,32 @@ func (t *Tree) GetByIndex(index int64) ([]byte, []byte) {
 }
 
 func (t *Tree) Get(key []byte) []byte {
+	if t.cache != nil {
+		if value, ok := t.cache.get(key); ok {
+			return value
+		}
+	}
+
 	_, value := t.GetWithIndex(key)
 	if value == nil {
 		return nil
 	}
 
+	if t.cache != nil {
+		// the caller may reuse its key buffer.
+		t.cache.add(bytes.Clone(key), value)
+	}
 	return value
 }
 
+// CacheStats returns the number of Get calls answered by the cache, and the number which missed it.
+func (t *Tree) CacheStats() (hits, misses int64) {
+	if t.cache == nil {
+		return 0, 0
+	}
+	return t.cache.hits, t.cache.misses
+}
+
 func (t *Tree) Has(key []byte) bool {
 	return t.Get(key) != nil
 }
@@ -132,7 +213,9 @@ func (t *Tree) ScanPostOrder(callback func(node Node) bool) {
 		entry := stack[len(stack)-1]
 
 		if entry.node.IsLeaf() || entry.expanded {
-			callback(entry.node)
+			if !callback(entry.node) {
+				return
+			}
 			stack = stack[:len(stack)-1]
 			continue
 		}
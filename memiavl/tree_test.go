@@ -1,10 +1,17 @@
 package memiavl
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"math/rand"
+	"os"
 	"testing"
 
+	ics23 "github.com/confio/ics23/go"
+	"github.com/kocubinski/iavlite/proof"
 	"github.com/kocubinski/iavlite/testutil"
+	"github.com/stretchr/testify/require"
 )
 
 func Test_BuildTree(t *testing.T) {
@@ -25,6 +32,700 @@ func Test_BuildTree(t *testing.T) {
 	fmt.Printf("treeHeightCounts: %v\n", heightCounts)
 }
 
+// buildRandomTree saves versions of leavesPerVersion random keys and returns the keys set.
+func buildRandomTree(t *testing.T, versions, leavesPerVersion int) (*Tree, [][]byte) {
+	tree := NewEmptyTree(0, 0, 0)
+	return tree, testutil.BuildRandomTree(t, tree, versions, leavesPerVersion)
+}
+
+func TestTree_GetMembershipProof(t *testing.T) {
+	_, err := NewEmptyTree(0, 0, 0).GetMembershipProof([]byte("key"))
+	require.Error(t, err)
+
+	tree, keys := buildRandomTree(t, 20, 50)
+	for _, key := range keys {
+		p, err := tree.GetMembershipProof(key)
+		require.NoError(t, err)
+		require.Equal(t, tree.Get(key), p.Value)
+		root, err := p.Calculate()
+		require.NoError(t, err)
+		require.Equal(t, tree.RootHash(), []byte(root))
+	}
+
+	p, err := tree.GetMembershipProof(keys[0])
+	require.NoError(t, err)
+	p.Value = []byte("tampered")
+	root, err := p.Calculate()
+	require.NoError(t, err)
+	require.NotEqual(t, tree.RootHash(), []byte(root))
+
+	_, err = tree.GetMembershipProof([]byte("missing key, longer than any random key"))
+	require.Error(t, err)
+}
+
+func TestTree_GetNonMembershipProof(t *testing.T) {
+	p, err := NewEmptyTree(0, 0, 0).GetNonMembershipProof([]byte("key"))
+	require.NoError(t, err)
+	require.Nil(t, p.Left)
+	require.Nil(t, p.Right)
+
+	tree, keys := buildRandomTree(t, 20, 50)
+	_, err = tree.GetNonMembershipProof(keys[0])
+	require.Error(t, err)
+
+	first, _ := tree.GetByIndex(0)
+	last, _ := tree.GetByIndex(tree.Size() - 1)
+	missing := [][]byte{{0x00}, append(bytes.Clone(last), 0x00)}
+	r := rand.New(rand.NewSource(4321))
+	for len(missing) < 200 {
+		key := make([]byte, 1+r.Intn(16))
+		r.Read(key)
+		if !tree.Has(key) {
+			missing = append(missing, key)
+		}
+	}
+	for _, key := range missing {
+		p, err := tree.GetNonMembershipProof(key)
+		require.NoError(t, err)
+		require.Equal(t, key, p.Key)
+		require.False(t, p.Left == nil && p.Right == nil)
+
+		index, _ := tree.GetWithIndex(key)
+		if p.Left == nil {
+			require.Equal(t, int64(0), index)
+			require.Equal(t, first, p.Right.Key)
+		} else {
+			root, err := p.Left.Calculate()
+			require.NoError(t, err)
+			require.Equal(t, tree.RootHash(), []byte(root))
+			require.Equal(t, -1, bytes.Compare(p.Left.Key, key))
+			leftIndex, _ := tree.GetWithIndex(p.Left.Key)
+			require.Equal(t, index-1, leftIndex)
+		}
+		if p.Right == nil {
+			require.Equal(t, tree.Size(), index)
+			require.Equal(t, last, p.Left.Key)
+		} else {
+			root, err := p.Right.Calculate()
+			require.NoError(t, err)
+			require.Equal(t, tree.RootHash(), []byte(root))
+			require.Equal(t, 1, bytes.Compare(p.Right.Key, key))
+			rightIndex, _ := tree.GetWithIndex(p.Right.Key)
+			require.Equal(t, index, rightIndex)
+		}
+	}
+}
+
+func TestTree_ProofICS23Encoding(t *testing.T) {
+	tree, keys := buildRandomTree(t, 20, 50)
+	root := tree.RootHash()
+	for _, key := range keys[:50] {
+		p, err := tree.GetMembershipProof(key)
+		require.NoError(t, err)
+		bz, err := (&proof.CommitmentProof{Proof: &ics23.CommitmentProof_Exist{Exist: p}}).Marshal()
+		require.NoError(t, err)
+		var decoded proof.CommitmentProof
+		require.NoError(t, decoded.Unmarshal(bz))
+		require.Equal(t, p, decoded.GetExist())
+		require.True(t, ics23.VerifyMembership(ics23.IavlSpec, root, &decoded, key, tree.Get(key)))
+		require.False(t, ics23.VerifyMembership(ics23.IavlSpec, root, &decoded, key, []byte("other value")))
+	}
+
+	for _, key := range [][]byte{{0x00}, []byte("missing key, longer than any random key")} {
+		p, err := tree.GetNonMembershipProof(key)
+		require.NoError(t, err)
+		bz, err := (&proof.CommitmentProof{Proof: &ics23.CommitmentProof_Nonexist{Nonexist: p}}).Marshal()
+		require.NoError(t, err)
+		var decoded proof.CommitmentProof
+		require.NoError(t, decoded.Unmarshal(bz))
+		require.True(t, ics23.VerifyNonMembership(ics23.IavlSpec, root, &decoded, key))
+	}
+}
+
+func TestTree_GetBatchProof(t *testing.T) {
+	tree, keys := buildRandomTree(t, 20, 50)
+	r := rand.New(rand.NewSource(4321))
+	var batch [][]byte
+	for i := 0; i < 50; i++ {
+		batch = append(batch, keys[r.Intn(len(keys))])
+		absent := make([]byte, 1+r.Intn(16))
+		r.Read(absent)
+		batch = append(batch, absent)
+	}
+
+	p, err := tree.GetBatchProof(batch)
+	require.NoError(t, err)
+	root, err := p.Calculate()
+	require.NoError(t, err)
+	require.Equal(t, tree.RootHash(), root)
+	for _, key := range batch {
+		value, err := p.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, tree.Get(key), value)
+	}
+	// inner nodes shared by the paths appear once, where separate existence proofs of the leaves repeat
+	// them along with the hashes of their siblings.
+	separate := 0
+	for _, key := range proofLeaves(p.Root, nil) {
+		existence, err := tree.GetMembershipProof(key)
+		require.NoError(t, err)
+		separate += 1 + 2*len(existence.Path)
+	}
+	require.Less(t, proofNodeCount(p.Root), separate)
+
+	// keys outside the batch aren't covered.
+	for _, key := range keys {
+		if _, err := p.Get(key); err != nil {
+			return
+		}
+	}
+	t.Fatal("batch proof covers every key")
+}
+
+func TestTree_GetRangeProof(t *testing.T) {
+	p, err := NewEmptyTree(0, 0, 0).GetRangeProof(nil, nil)
+	require.NoError(t, err)
+	root, err := p.Calculate()
+	require.NoError(t, err)
+	require.Equal(t, emptyHash, root)
+	pairs, err := p.Range(nil, nil)
+	require.NoError(t, err)
+	require.Empty(t, pairs)
+
+	tree, _ := buildRandomTree(t, 20, 50)
+	r := rand.New(rand.NewSource(4321))
+	bound := func() []byte {
+		if r.Intn(10) == 0 {
+			return nil
+		}
+		key := make([]byte, 1+r.Intn(2))
+		r.Read(key)
+		return key
+	}
+	for i := 0; i < 100; i++ {
+		start, end := bound(), bound()
+		if start != nil && end != nil && bytes.Compare(start, end) >= 0 {
+			_, err := tree.GetRangeProof(start, end)
+			require.Error(t, err)
+			continue
+		}
+		p, err := tree.GetRangeProof(start, end)
+		require.NoError(t, err)
+		root, err := p.Calculate()
+		require.NoError(t, err)
+		require.Equal(t, tree.RootHash(), root)
+
+		var expected []proof.KVPair
+		for j := int64(0); j < tree.Size(); j++ {
+			key, value := tree.GetByIndex(j)
+			if (start == nil || bytes.Compare(key, start) >= 0) && (end == nil || bytes.Compare(key, end) < 0) {
+				expected = append(expected, proof.KVPair{Key: key, Value: value})
+			}
+		}
+		pairs, err := p.Range(start, end)
+		require.NoError(t, err)
+		require.Equal(t, expected, pairs)
+
+		// leaving out a leaf of the range breaks completeness, although the root hash still matches.
+		if len(expected) > 0 {
+			leaf := findProofLeaf(p.Root, expected[len(expected)/2].Key)
+			*leaf = proof.ProofNode{Hash: HashNode(newLeafNode(leaf.Key, leaf.Value, uint32(leaf.Version)))}
+			root, err := p.Calculate()
+			require.NoError(t, err)
+			require.Equal(t, tree.RootHash(), root)
+			_, err = p.Range(start, end)
+			require.Error(t, err)
+		}
+	}
+}
+
+func TestTree_ProofUnsaved(t *testing.T) {
+	tree, keys := buildRandomTree(t, 5, 20)
+	requireUnsaved := func() {
+		_, err := tree.GetMembershipProof(keys[1])
+		require.Error(t, err)
+		_, err = tree.GetNonMembershipProof([]byte("absent"))
+		require.Error(t, err)
+		_, err = tree.GetBatchProof(keys[:2])
+		require.Error(t, err)
+		_, err = tree.GetRangeProof(nil, nil)
+		require.Error(t, err)
+		_, err = tree.Snapshot().GetMembershipProof(keys[1])
+		require.Error(t, err)
+	}
+	_, err := tree.Set([]byte("unsaved"), []byte("value"))
+	require.NoError(t, err)
+	requireUnsaved()
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	// removing a key can leave an existing subtree at the root.
+	_, removed, err := tree.Remove(keys[0])
+	require.NoError(t, err)
+	require.True(t, removed)
+	requireUnsaved()
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	_, err = tree.GetMembershipProof(keys[1])
+	require.NoError(t, err)
+	_, err = tree.GetNonMembershipProof([]byte("absent"))
+	require.NoError(t, err)
+	_, err = tree.GetBatchProof(keys[:2])
+	require.NoError(t, err)
+}
+
+func TestTree_Snapshot(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, leaves := range []int{0, 1} {
+		tree := NewEmptyTree(0, 0, 0)
+		if leaves > 0 {
+			_, err := tree.Set([]byte("key"), []byte("value"))
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		path := fmt.Sprintf("%s/small-%d.snapshot", dir, leaves)
+		require.NoError(t, tree.WriteSnapshot(path))
+		snapshot, err := OpenSnapshot(path)
+		require.NoError(t, err)
+		loaded := NewFromSnapshot(snapshot, 0)
+		require.Equal(t, tree.Version(), loaded.Version())
+		require.Equal(t, tree.RootHash(), loaded.RootHash())
+		require.Equal(t, tree.Get([]byte("key")), loaded.Get([]byte("key")))
+		require.NoError(t, snapshot.Close())
+	}
+
+	tree, keys := buildRandomTree(t, 20, 50)
+	path := dir + "/tree.snapshot"
+	require.NoError(t, tree.WriteSnapshot(path))
+	snapshot, err := OpenSnapshot(path)
+	require.NoError(t, err)
+	defer snapshot.Close()
+
+	loaded := NewFromSnapshot(snapshot, 0)
+	require.Equal(t, tree.Version(), loaded.Version())
+	require.Equal(t, tree.Size(), loaded.Size())
+	require.Equal(t, tree.Height(), loaded.Height())
+	require.Equal(t, tree.RootHash(), loaded.RootHash())
+	require.True(t, VerifyHash(loaded.root))
+	for _, key := range keys {
+		index, value := tree.GetWithIndex(key)
+		loadedIndex, loadedValue := loaded.GetWithIndex(key)
+		require.Equal(t, index, loadedIndex)
+		require.Equal(t, value, loadedValue)
+	}
+	for i := int64(0); i < tree.Size(); i++ {
+		key, value := tree.GetByIndex(i)
+		loadedKey, loadedValue := loaded.GetByIndex(i)
+		require.Equal(t, key, loadedKey)
+		require.Equal(t, value, loadedValue)
+	}
+	index, value := loaded.GetWithIndex([]byte{0x00})
+	require.Zero(t, index)
+	require.Nil(t, value)
+
+	// both trees stay equal under the same changes, mutated nodes of the snapshot being cloned.
+	r := rand.New(rand.NewSource(4321))
+	for v := 0; v < 10; v++ {
+		for i := 0; i < 50; i++ {
+			if i%3 == 0 {
+				key := keys[r.Intn(len(keys))]
+				_, removed, err := tree.Remove(key)
+				require.NoError(t, err)
+				_, loadedRemoved, err := loaded.Remove(key)
+				require.NoError(t, err)
+				require.Equal(t, removed, loadedRemoved)
+				continue
+			}
+			key := make([]byte, 1+r.Intn(16))
+			r.Read(key)
+			value := []byte(fmt.Sprintf("new-value-%d-%d", v, i))
+			_, err := tree.Set(key, value)
+			require.NoError(t, err)
+			_, err = loaded.Set(key, value)
+			require.NoError(t, err)
+		}
+		hash, version, err := tree.SaveVersion()
+		require.NoError(t, err)
+		loadedHash, loadedVersion, err := loaded.SaveVersion()
+		require.NoError(t, err)
+		require.Equal(t, version, loadedVersion)
+		require.Equal(t, hash, loadedHash)
+	}
+
+	_, err = OpenSnapshot(dir + "/missing.snapshot")
+	require.Error(t, err)
+	require.NoError(t, os.WriteFile(dir+"/invalid.snapshot", bytes.Repeat([]byte{1}, 64), 0o600))
+	_, err = OpenSnapshot(dir + "/invalid.snapshot")
+	require.Error(t, err)
+}
+
+func TestTree_SnapshotCorrupted(t *testing.T) {
+	dir := t.TempDir()
+	tree, _ := buildRandomTree(t, 5, 20)
+	path := dir + "/tree.snapshot"
+	require.NoError(t, tree.WriteSnapshot(path))
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	leafCount := int(binary.LittleEndian.Uint32(data[16:]))
+	nodesOffset := snapshotHeaderSize + leafCount*sizeLeaf
+	rootOffset := nodesOffset + (leafCount-2)*sizeNode
+
+	// corruptions which keep the size of the file are caught on open rather than when reading nodes.
+	cases := map[string]func(data []byte){
+		"left ref":   func(data []byte) { binary.LittleEndian.PutUint32(data[rootOffset+20:], 1<<30) },
+		"right leaf": func(data []byte) { binary.LittleEndian.PutUint32(data[rootOffset+24:], leafRef|1<<30) },
+		"key leaf":   func(data []byte) { binary.LittleEndian.PutUint32(data[rootOffset+16:], 1<<30) },
+		"size":       func(data []byte) { binary.LittleEndian.PutUint64(data[rootOffset+8:], 1<<40) },
+		"kv offset":  func(data []byte) { binary.LittleEndian.PutUint64(data[snapshotHeaderSize+16:], 1<<40) },
+		"key length": func(data []byte) { binary.LittleEndian.PutUint32(data[snapshotHeaderSize+4:], 1<<30) },
+	}
+	for name, corrupt := range cases {
+		corrupted := bytes.Clone(data)
+		corrupt(corrupted)
+		require.NoError(t, os.WriteFile(path, corrupted, 0o600), name)
+		_, err := OpenSnapshot(path)
+		require.Error(t, err, name)
+	}
+}
+
+func TestTree_ChangesetLog(t *testing.T) {
+	dir := t.TempDir()
+	log, err := OpenChangesetLog(dir + "/changesets")
+	require.NoError(t, err)
+
+	r := rand.New(rand.NewSource(1234))
+	tree := NewEmptyTree(0, 10, 0)
+	tree.SetChangesetLog(log)
+	var keys [][]byte
+	var snapshotHash []byte
+	for v := 0; v < 20; v++ {
+		for i := 0; i < 50; i++ {
+			if i%5 == 0 && len(keys) > 0 {
+				_, _, err := tree.Remove(keys[r.Intn(len(keys))])
+				require.NoError(t, err)
+				continue
+			}
+			key := make([]byte, 1+r.Intn(16))
+			r.Read(key)
+			_, err := tree.Set(key, []byte(fmt.Sprintf("value-%d-%d", v, i)))
+			require.NoError(t, err)
+			keys = append(keys, key)
+		}
+		hash, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		if v == 9 {
+			require.NoError(t, tree.WriteSnapshot(dir+"/tree.snapshot"))
+			snapshotHash = hash
+		}
+	}
+	require.Equal(t, int64(29), tree.Version())
+	require.NoError(t, log.Close())
+
+	log, err = OpenChangesetLog(dir + "/changesets")
+	require.NoError(t, err)
+	defer log.Close()
+
+	// from the log alone, starting at the initial version.
+	replayed, snapshot, err := ReplayTree(dir+"/missing.snapshot", log, 0)
+	require.NoError(t, err)
+	require.Nil(t, snapshot)
+	require.Equal(t, tree.Version(), replayed.Version())
+	require.Equal(t, tree.RootHash(), replayed.RootHash())
+
+	// from the snapshot and the versions logged after it.
+	replayed, snapshot, err = ReplayTree(dir+"/tree.snapshot", log, 0)
+	require.NoError(t, err)
+	require.NotNil(t, snapshot)
+	defer snapshot.Close()
+	require.Equal(t, uint32(19), snapshot.Version())
+	require.Equal(t, snapshotHash, snapshot.RootNode().Hash())
+	require.Equal(t, tree.Version(), replayed.Version())
+	require.Equal(t, tree.RootHash(), replayed.RootHash())
+	for _, key := range keys {
+		require.Equal(t, tree.Get(key), replayed.Get(key))
+	}
+
+	// versions saved after the replay are logged.
+	_, err = replayed.Set([]byte("replayed"), []byte("value"))
+	require.NoError(t, err)
+	hash, version, err := replayed.SaveVersion()
+	require.NoError(t, err)
+	relogged, _, err := ReplayTree(dir+"/missing.snapshot", log, 0)
+	require.NoError(t, err)
+	require.Equal(t, version, relogged.Version())
+	require.Equal(t, hash, relogged.RootHash())
+
+	// replaying into a tree which logs to the same log doesn't append the versions again.
+	last, err := log.log.LastIndex()
+	require.NoError(t, err)
+	attached := NewEmptyTree(0, 10, 0)
+	attached.SetChangesetLog(log)
+	require.NoError(t, log.Replay(attached))
+	require.Equal(t, version, attached.Version())
+	require.Same(t, log, attached.changesetLog)
+	relast, err := log.log.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, last, relast)
+	require.Contains(t, (&ChangeSetEntry{Version: version}).String(), fmt.Sprint(version))
+
+	// a replay which diverges from the logged hashes fails.
+	diverged := NewEmptyTree(0, 10, 0)
+	_, err = diverged.Set([]byte("unlogged"), []byte("value"))
+	require.NoError(t, err)
+	require.Error(t, log.Replay(diverged))
+}
+
+func TestTree_Snapshot_CopyOnWrite(t *testing.T) {
+	tree, keys := buildRandomTree(t, 10, 50)
+	_, err := tree.Set([]byte("unsaved"), []byte("value"))
+	require.NoError(t, err)
+
+	view := tree.Snapshot()
+	hash := bytes.Clone(view.RootHash())
+	version := view.Version()
+	values := make(map[string][]byte)
+	for _, key := range keys {
+		values[string(key)] = tree.Get(key)
+	}
+	values["unsaved"] = []byte("value")
+
+	// reads of the view run while the tree goes through the next versions.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, key := range keys {
+			require.Equal(t, values[string(key)], view.Get(key))
+		}
+	}()
+	r := rand.New(rand.NewSource(4321))
+	for v := 0; v < 5; v++ {
+		for i := 0; i < 50; i++ {
+			key := keys[r.Intn(len(keys))]
+			if i%3 == 0 {
+				_, _, err := tree.Remove(key)
+				require.NoError(t, err)
+				continue
+			}
+			_, err := tree.Set(key, []byte(fmt.Sprintf("new-value-%d-%d", v, i)))
+			require.NoError(t, err)
+		}
+		_, _, err := tree.Remove([]byte("unsaved"))
+		require.NoError(t, err)
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	<-done
+
+	require.NotEqual(t, hash, tree.RootHash())
+	require.Equal(t, hash, view.RootHash())
+	require.Equal(t, version, view.Version())
+	require.True(t, VerifyHash(view.tree.root))
+	for key, value := range values {
+		require.Equal(t, value, view.Get([]byte(key)))
+	}
+	// the view holds changes which were never saved, so it has no root hash to prove them against.
+	_, err = view.GetMembershipProof([]byte("unsaved"))
+	require.Error(t, err)
+}
+
+func TestTree_Iterator(t *testing.T) {
+	tree, _ := buildRandomTree(t, 20, 50)
+	var keys [][]byte
+	kv := make(map[string][]byte)
+	for i := int64(0); i < tree.Size(); i++ {
+		key, value := tree.GetByIndex(i)
+		keys = append(keys, key)
+		kv[string(key)] = value
+	}
+
+	cases := []struct {
+		name       string
+		start, end []byte
+		want       [][]byte
+	}{
+		{name: "full", want: keys},
+		{name: "start", start: keys[100], want: keys[100:]},
+		{name: "end", end: keys[200], want: keys[:200]},
+		{name: "range", start: keys[50], end: keys[500], want: keys[50:500]},
+		{name: "between keys", start: append(bytes.Clone(keys[10]), 0), end: append(bytes.Clone(keys[20]), 0),
+			want: keys[11:21]},
+		{name: "empty", start: keys[30], end: keys[30], want: nil},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, ascending := range []bool{true, false} {
+				itr, err := tree.Iterator(tc.start, tc.end, ascending)
+				require.NoError(t, err)
+				start, end := itr.Domain()
+				require.Equal(t, tc.start, start)
+				require.Equal(t, tc.end, end)
+				var got [][]byte
+				for ; itr.Valid(); itr.Next() {
+					require.Equal(t, kv[string(itr.Key())], itr.Value())
+					got = append(got, itr.Key())
+				}
+				require.NoError(t, itr.Error())
+				require.NoError(t, itr.Close())
+				require.Panics(t, func() { itr.Key() })
+				if !ascending {
+					for i, j := 0, len(got)-1; i < j; i, j = i+1, j-1 {
+						got[i], got[j] = got[j], got[i]
+					}
+				}
+				require.Equal(t, tc.want, got)
+			}
+		})
+	}
+
+	itr, err := NewEmptyTree(0, 0, 0).Iterator(nil, nil, true)
+	require.NoError(t, err)
+	require.False(t, itr.Valid())
+	_, err = tree.Iterator([]byte{}, nil, true)
+	require.Error(t, err)
+}
+
+func TestTree_Cache(t *testing.T) {
+	tree := NewEmptyTree(0, 0, 100)
+	uncached := NewEmptyTree(0, 0, 0)
+	r := rand.New(rand.NewSource(1234))
+	var keys [][]byte
+	for v := 0; v < 10; v++ {
+		for i := 0; i < 50; i++ {
+			key := []byte(fmt.Sprintf("key-%d", r.Intn(300)))
+			if i%4 == 0 {
+				_, _, err := tree.Remove(key)
+				require.NoError(t, err)
+				_, _, err = uncached.Remove(key)
+				require.NoError(t, err)
+				continue
+			}
+			value := []byte(fmt.Sprintf("value-%d-%d", v, i))
+			_, err := tree.Set(key, value)
+			require.NoError(t, err)
+			_, err = uncached.Set(key, value)
+			require.NoError(t, err)
+			keys = append(keys, key)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		_, _, err = uncached.SaveVersion()
+		require.NoError(t, err)
+
+		// reads through the cache agree with the tree after sets and removes.
+		for i := 0; i < 300; i++ {
+			key := []byte(fmt.Sprintf("key-%d", i))
+			require.Equal(t, uncached.Get(key), tree.Get(key))
+			require.Equal(t, uncached.Has(key), tree.Has(key))
+		}
+	}
+	require.Equal(t, uncached.RootHash(), tree.RootHash())
+	require.Len(t, tree.cache.entries, 100)
+	require.Equal(t, 100, tree.cache.lru.Len())
+
+	hits, misses := tree.CacheStats()
+	require.Positive(t, hits)
+	require.Positive(t, misses)
+	require.Equal(t, int64(10*300*2), hits+misses)
+
+	// a recently read key hits.
+	tree.Get(keys[len(keys)-1])
+	afterHits, _ := tree.CacheStats()
+	require.Equal(t, hits+1, afterHits)
+
+	hits, misses = uncached.CacheStats()
+	require.Zero(t, hits)
+	require.Zero(t, misses)
+}
+
+func TestTree_Count(t *testing.T) {
+	empty := NewEmptyTree(0, 0, 0)
+	require.Zero(t, empty.CountRange(nil, nil))
+	require.Zero(t, empty.CountPrefix([]byte{0x01}))
+	require.Nil(t, empty.KeyAtRank(0))
+
+	tree, _ := buildRandomTree(t, 20, 50)
+	for _, key := range [][]byte{{0xff}, {0xff, 0xff}, {0xff, 0xff, 0x00}, {0x01, 0xff}, {0x02}} {
+		_, err := tree.Set(key, []byte("value"))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	var keys [][]byte
+	for i := int64(0); i < tree.Size(); i++ {
+		key, _ := tree.GetByIndex(i)
+		keys = append(keys, key)
+	}
+
+	count := func(match func(key []byte) bool) int64 {
+		var n int64
+		for _, key := range keys {
+			if match(key) {
+				n++
+			}
+		}
+		return n
+	}
+	inRange := func(start, end []byte) func([]byte) bool {
+		return func(key []byte) bool {
+			return (start == nil || bytes.Compare(key, start) >= 0) && (end == nil || bytes.Compare(key, end) < 0)
+		}
+	}
+
+	require.Equal(t, tree.Size(), tree.CountRange(nil, nil))
+	for _, r := range [][2][]byte{
+		{keys[10], keys[500]}, {nil, keys[200]}, {keys[300], nil}, {{0x40}, {0x48}},
+		{append(bytes.Clone(keys[7]), 0), keys[9]}, {keys[9], keys[9]}, {keys[9], keys[3]},
+	} {
+		require.Equal(t, count(inRange(r[0], r[1])), tree.CountRange(r[0], r[1]))
+	}
+	for _, prefix := range [][]byte{nil, {0x01}, {0x40}, {0x7f}, {0xff}, {0xff, 0xff}, {0x01, 0xff}, keys[42]} {
+		require.Equal(t, count(func(key []byte) bool { return bytes.HasPrefix(key, prefix) }), tree.CountPrefix(prefix),
+			"prefix %X", prefix)
+	}
+
+	for i, key := range keys {
+		require.Equal(t, key, tree.KeyAtRank(int64(i)))
+	}
+	require.Nil(t, tree.KeyAtRank(-1))
+	require.Nil(t, tree.KeyAtRank(tree.Size()))
+}
+
+func proofNodeCount(n *proof.ProofNode) int {
+	if n == nil {
+		return 0
+	}
+	return 1 + proofNodeCount(n.Left) + proofNodeCount(n.Right)
+}
+
+func proofLeaves(n *proof.ProofNode, keys [][]byte) [][]byte {
+	switch {
+	case n.Hash != nil:
+		return keys
+	case n.Height == 0:
+		return append(keys, n.Key)
+	default:
+		return proofLeaves(n.Right, proofLeaves(n.Left, keys))
+	}
+}
+
+func findProofLeaf(n *proof.ProofNode, key []byte) *proof.ProofNode {
+	if n == nil || n.Hash != nil {
+		return nil
+	}
+	if n.Height == 0 {
+		if bytes.Equal(n.Key, key) {
+			return n
+		}
+		return nil
+	}
+	if leaf := findProofLeaf(n.Left, key); leaf != nil {
+		return leaf
+	}
+	return findProofLeaf(n.Right, key)
+}
+
 func treeCount(node Node) int {
 	if node == nil {
 		return 0
@@ -0,0 +1,29 @@
+package memiavl
+
+import (
+	"github.com/gogo/protobuf/proto"
+	v1 "github.com/kocubinski/iavlite/v1"
+)
+
+// KVPair and ChangeSet are the change messages of v1, so that the changeset log records the same proto
+// shape.
+type (
+	KVPair    = v1.KVPair
+	ChangeSet = v1.ChangeSet
+)
+
+var _ proto.Message = (*ChangeSetEntry)(nil)
+
+// ChangeSetEntry is a record of the changeset log, the changes of one version and the root hash they
+// resulted in.
+type ChangeSetEntry struct {
+	Version   int64      `protobuf:"varint,1,opt,name=version,proto3" json:"version,omitempty"`
+	RootHash  []byte     `protobuf:"bytes,2,opt,name=root_hash,proto3" json:"root_hash,omitempty"`
+	ChangeSet *ChangeSet `protobuf:"bytes,3,opt,name=change_set,proto3" json:"change_set,omitempty"`
+}
+
+func (e *ChangeSetEntry) Reset() { *e = ChangeSetEntry{} }
+
+func (e *ChangeSetEntry) String() string { return proto.CompactTextString(e) }
+
+func (e *ChangeSetEntry) ProtoMessage() {}
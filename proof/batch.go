@@ -0,0 +1,325 @@
+package proof
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// BatchProof proves a set of keys, and optionally the completeness of key ranges, with one pruned copy
+// of an IAVL tree. It holds the paths from the root to the proven leaves, so inner nodes shared by
+// several paths appear once, and replaces every subtree off those paths by its hash.
+type BatchProof struct {
+	// Root is nil for an empty tree.
+	Root *ProofNode
+}
+
+// ProofNode is a node of a BatchProof. A pruned subtree only has Hash set. Otherwise Height, Size and
+// Version are those of the tree node, leaves have Key and Value, and inner nodes both children.
+type ProofNode struct {
+	Hash []byte
+
+	Height  int8
+	Size    int64
+	Version int64
+	Key     []byte
+	Value   []byte
+	Left    *ProofNode
+	Right   *ProofNode
+}
+
+// TreeNode is a node of a saved IAVL tree, which batch and range proofs are built from. Height is zero
+// for leaves, and Left and Right are only called on inner nodes.
+type TreeNode interface {
+	Height() int8
+	Size() int64
+	Version() int64
+	Key() []byte
+	Value() []byte
+	Hash() []byte
+	Left() TreeNode
+	Right() TreeNode
+}
+
+// NewBatchProof returns one proof of the values of keys in the tree of root, which is nil for an empty
+// tree. Keys which are absent are proven so by including the leaves on either side of them.
+func NewBatchProof(root TreeNode, keys [][]byte) *BatchProof {
+	if root == nil {
+		return &BatchProof{}
+	}
+	var leaves [][]byte
+	for _, key := range keys {
+		index, found := getIndex(root, key)
+		if found {
+			leaves = append(leaves, key)
+			continue
+		}
+		if index > 0 {
+			leaves = append(leaves, getByIndex(root, index-1))
+		}
+		if index < root.Size() {
+			leaves = append(leaves, getByIndex(root, index))
+		}
+	}
+	sort.Slice(leaves, func(i, j int) bool {
+		return bytes.Compare(leaves[i], leaves[j]) < 0
+	})
+	return &BatchProof{Root: proofNode(root, leaves)}
+}
+
+// NewRangeProof returns a proof of every key in [start, end) in the tree of root, which is nil for an
+// empty tree, along with the leaves just outside the range which prove that no other keys are in it. A
+// nil start or end leaves that side unbounded.
+func NewRangeProof(root TreeNode, start, end []byte) (*BatchProof, error) {
+	if start != nil && end != nil && bytes.Compare(start, end) >= 0 {
+		return nil, fmt.Errorf("invalid range [%X, %X)", start, end)
+	}
+	if root == nil {
+		return &BatchProof{}, nil
+	}
+	from, to := int64(0), root.Size()
+	if start != nil {
+		from, _ = getIndex(root, start)
+	}
+	if end != nil {
+		to, _ = getIndex(root, end)
+	}
+	// the index range is widened by one on either side for the neighbours of the range.
+	if from > 0 {
+		from--
+	}
+	if to < root.Size() {
+		to++
+	}
+	var leaves [][]byte
+	for i := from; i < to; i++ {
+		leaves = append(leaves, getByIndex(root, i))
+	}
+	return &BatchProof{Root: proofNode(root, leaves)}, nil
+}
+
+// getIndex returns the index of key, or the index it would have if absent, and whether it is present.
+func getIndex(node TreeNode, key []byte) (int64, bool) {
+	var index int64
+	for node.Height() > 0 {
+		if bytes.Compare(key, node.Key()) < 0 {
+			node = node.Left()
+			continue
+		}
+		left := node.Left()
+		index += left.Size()
+		node = node.Right()
+	}
+	switch bytes.Compare(node.Key(), key) {
+	case -1:
+		return index + 1, false
+	case 1:
+		return index, false
+	default:
+		return index, true
+	}
+}
+
+// getByIndex returns the key of the leaf at index, which must be in range.
+func getByIndex(node TreeNode, index int64) []byte {
+	for node.Height() > 0 {
+		left := node.Left()
+		if index < left.Size() {
+			node = left
+			continue
+		}
+		index -= left.Size()
+		node = node.Right()
+	}
+	return node.Key()
+}
+
+// proofNode copies the paths from node to the leaves of keys, which are sorted, pruning the other
+// subtrees to their hashes.
+func proofNode(node TreeNode, keys [][]byte) *ProofNode {
+	if len(keys) == 0 {
+		return &ProofNode{Hash: node.Hash()}
+	}
+	n := &ProofNode{
+		Height:  node.Height(),
+		Size:    node.Size(),
+		Version: node.Version(),
+	}
+	if node.Height() == 0 {
+		n.Key = node.Key()
+		n.Value = node.Value()
+		return n
+	}
+	// keys of the right subtree are at least node.Key().
+	split := sort.Search(len(keys), func(i int) bool {
+		return bytes.Compare(keys[i], node.Key()) >= 0
+	})
+	n.Left = proofNode(node.Left(), keys[:split])
+	n.Right = proofNode(node.Right(), keys[split:])
+	return n
+}
+
+// KVPair is a key and value proven by a BatchProof.
+type KVPair struct {
+	Key   []byte
+	Value []byte
+}
+
+func (n *ProofNode) isPruned() bool {
+	return n.Hash != nil
+}
+
+func (n *ProofNode) isLeaf() bool {
+	return n.Height == 0
+}
+
+// hash computes the hash of the node the same way as writeHashBytes of the trees.
+func (n *ProofNode) hash() ([]byte, error) {
+	if n.isPruned() {
+		if len(n.Hash) != sha256.Size {
+			return nil, fmt.Errorf("pruned node hash has length %d", len(n.Hash))
+		}
+		return n.Hash, nil
+	}
+	data := nodePrefix(int64(n.Height), n.Size, n.Version)
+	if n.isLeaf() {
+		if n.Size != 1 || n.Left != nil || n.Right != nil {
+			return nil, errors.New("invalid leaf node")
+		}
+		if len(n.Key) == 0 {
+			return nil, errors.New("leaf node has no key")
+		}
+		valueHash := sha256.Sum256(n.Value)
+		data = appendBytes(data, n.Key)
+		data = appendBytes(data, valueHash[:])
+		h := sha256.Sum256(data)
+		return h[:], nil
+	}
+	if n.Left == nil || n.Right == nil {
+		return nil, errors.New("inner node is missing children")
+	}
+	left, err := n.Left.hash()
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.Right.hash()
+	if err != nil {
+		return nil, err
+	}
+	data = appendBytes(data, left)
+	data = appendBytes(data, right)
+	h := sha256.Sum256(data)
+	return h[:], nil
+}
+
+func appendBytes(data, bz []byte) []byte {
+	data = binary.AppendUvarint(data, uint64(len(bz)))
+	return append(data, bz...)
+}
+
+// EmptyHash is the root hash of an empty tree, the hash of no data.
+var EmptyHash = func() []byte {
+	h := sha256.Sum256(nil)
+	return h[:]
+}()
+
+// Calculate returns the root hash committed to by the proof, which is EmptyHash for an empty tree.
+func (p *BatchProof) Calculate() ([]byte, error) {
+	if p.Root == nil {
+		return EmptyHash, nil
+	}
+	return p.Root.hash()
+}
+
+// items returns the leaves and pruned subtrees of the proof in key order, checking that the leaf keys
+// ascend.
+func (p *BatchProof) items() ([]*ProofNode, error) {
+	var items []*ProofNode
+	var walk func(n *ProofNode) error
+	walk = func(n *ProofNode) error {
+		if n == nil {
+			return errors.New("inner node is missing children")
+		}
+		if n.isPruned() || n.isLeaf() {
+			items = append(items, n)
+			return nil
+		}
+		if err := walk(n.Left); err != nil {
+			return err
+		}
+		return walk(n.Right)
+	}
+	if p.Root != nil {
+		if err := walk(p.Root); err != nil {
+			return nil, err
+		}
+	}
+	var last []byte
+	for _, n := range items {
+		if n.isPruned() {
+			continue
+		}
+		if last != nil && bytes.Compare(last, n.Key) >= 0 {
+			return nil, errors.New("leaf keys of proof are not in ascending order")
+		}
+		last = n.Key
+	}
+	return items, nil
+}
+
+// Range returns the leaves of the proof with keys in [start, end), and an error unless the proof shows
+// that the tree has no other keys in that range. A nil start or end leaves that side unbounded. The
+// proof must have been checked against a root hash with Calculate.
+func (p *BatchProof) Range(start, end []byte) ([]KVPair, error) {
+	if start != nil && end != nil && bytes.Compare(start, end) >= 0 {
+		return nil, fmt.Errorf("invalid range [%X, %X)", start, end)
+	}
+	items, err := p.items()
+	if err != nil {
+		return nil, err
+	}
+	var pairs []KVPair
+	for i, n := range items {
+		if !n.isPruned() {
+			if (start == nil || bytes.Compare(n.Key, start) >= 0) && (end == nil || bytes.Compare(n.Key, end) < 0) {
+				pairs = append(pairs, KVPair{Key: n.Key, Value: n.Value})
+			}
+			continue
+		}
+		// keys of a pruned subtree lie strictly between the leaves around it.
+		var below, above []byte
+		for j := i - 1; j >= 0 && below == nil; j-- {
+			if !items[j].isPruned() {
+				below = items[j].Key
+			}
+		}
+		for j := i + 1; j < len(items) && above == nil; j++ {
+			if !items[j].isPruned() {
+				above = items[j].Key
+			}
+		}
+		// the least key above below is below||0x00.
+		if (below == nil || end == nil || bytes.Compare(append(bytes.Clone(below), 0), end) < 0) &&
+			(above == nil || start == nil || bytes.Compare(start, above) < 0) {
+			return nil, fmt.Errorf("proof does not cover range [%X, %X)", start, end)
+		}
+	}
+	return pairs, nil
+}
+
+// Get returns the value of key, or nil if the proof shows key is absent. It returns an error if the
+// proof covers neither.
+func (p *BatchProof) Get(key []byte) ([]byte, error) {
+	// key||0x00 is the least key greater than key.
+	pairs, err := p.Range(key, append(bytes.Clone(key), 0))
+	if err != nil {
+		return nil, err
+	}
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	return pairs[0].Value, nil
+}
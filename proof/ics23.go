@@ -0,0 +1,99 @@
+// Package proof holds ICS23 commitment proofs of IAVL trees and verifies membership, non-membership and
+// range proofs against a root hash. It imports no tree implementation, so light clients and relayers only
+// need this package. The proof types are those of github.com/confio/ics23/go, so proofs encode to the
+// protobuf messages IBC accepts and verify against ics23.IavlSpec.
+package proof
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+
+	ics23 "github.com/confio/ics23/go"
+)
+
+type (
+	// HashOp is the hash function applied by a LeafOp or InnerOp.
+	HashOp = ics23.HashOp
+	// LengthOp is the length prefix applied to the key and value of a leaf.
+	LengthOp = ics23.LengthOp
+
+	// LeafOp computes the hash of a leaf from its key and value:
+	//
+	//	Hash(Prefix || Length(PrehashKey(key)) || Length(PrehashValue(value)))
+	LeafOp = ics23.LeafOp
+	// InnerOp computes the hash of an inner node from the hash of the child on the path: Hash(Prefix ||
+	// child || Suffix). The hash of the other child is part of Prefix or Suffix.
+	InnerOp = ics23.InnerOp
+
+	// ExistenceProof proves that Key is set to Value in the tree. Path holds the inner nodes from the
+	// parent of the leaf up to the root.
+	ExistenceProof = ics23.ExistenceProof
+	// NonExistenceProof proves that Key is not in the tree with existence proofs of its neighbours, the
+	// greatest key below it and the least key above it. Left is nil if Key is before the first key and
+	// Right if it is after the last. Both are nil only for an empty tree.
+	NonExistenceProof = ics23.NonExistenceProof
+	// CommitmentProof is the protobuf envelope of an existence or non-existence proof.
+	CommitmentProof = ics23.CommitmentProof
+)
+
+const (
+	HashOpNoHash = ics23.HashOp_NO_HASH
+	HashOpSHA256 = ics23.HashOp_SHA256
+
+	LengthOpNoPrefix = ics23.LengthOp_NO_PREFIX
+	// LengthOpVarProto prefixes the data with its length as a protobuf (unsigned) varint.
+	LengthOpVarProto = ics23.LengthOp_VAR_PROTO
+)
+
+// IavlSpec is the ics23 spec that IAVL proofs satisfy.
+var IavlSpec = ics23.IavlSpec
+
+// IavlLeafOp returns the LeafOp of an IAVL leaf saved at version. An IAVL leaf is hashed as
+//
+//	SHA256(varint(0) || varint(1) || varint(version) || uvarint(len(key)) || key ||
+//	uvarint(32) || SHA256(value))
+//
+// which is height, size and version followed by the key and the hash of the value.
+func IavlLeafOp(version int64) *LeafOp {
+	return &LeafOp{
+		Hash:         HashOpSHA256,
+		PrehashKey:   HashOpNoHash,
+		PrehashValue: HashOpSHA256,
+		Length:       LengthOpVarProto,
+		Prefix:       fullSlice(nodePrefix(0, 1, version)),
+	}
+}
+
+// IavlInnerOp returns the InnerOp of an IAVL inner node with the given height, size and version. An IAVL
+// inner node is hashed as
+//
+//	SHA256(varint(height) || varint(size) || varint(version) || uvarint(len(left)) || left ||
+//	uvarint(len(right)) || right)
+//
+// sibling is the hash of the child off the path, which is the right child if pathLeft.
+func IavlInnerOp(height int8, size, version int64, sibling []byte, pathLeft bool) *InnerOp {
+	prefix := nodePrefix(int64(height), size, version)
+	if pathLeft {
+		// the child hash on the path is 32 bytes.
+		prefix = binary.AppendUvarint(prefix, sha256.Size)
+		suffix := binary.AppendUvarint(nil, uint64(len(sibling)))
+		return &InnerOp{Hash: HashOpSHA256, Prefix: fullSlice(prefix), Suffix: append(suffix, sibling...)}
+	}
+	prefix = binary.AppendUvarint(prefix, uint64(len(sibling)))
+	prefix = append(prefix, sibling...)
+	prefix = binary.AppendUvarint(prefix, sha256.Size)
+	return &InnerOp{Hash: HashOpSHA256, Prefix: fullSlice(prefix)}
+}
+
+func nodePrefix(height, size, version int64) []byte {
+	prefix := make([]byte, 0, 3*binary.MaxVarintLen64)
+	prefix = binary.AppendVarint(prefix, height)
+	prefix = binary.AppendVarint(prefix, size)
+	return binary.AppendVarint(prefix, version)
+}
+
+// fullSlice caps bz at its length. ics23 appends the hashed data to op prefixes, which must not write
+// into spare capacity shared by every hash of the op.
+func fullSlice(bz []byte) []byte {
+	return bz[:len(bz):len(bz)]
+}
@@ -0,0 +1,252 @@
+package proof
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// VerifyMembership checks that p proves key is set to value in the tree with the given root hash.
+func VerifyMembership(root []byte, p *ExistenceProof, key, value []byte) error {
+	if p == nil {
+		return errors.New("missing existence proof")
+	}
+	if !bytes.Equal(p.Key, key) {
+		return fmt.Errorf("proof is of key %X, not %X", p.Key, key)
+	}
+	if !bytes.Equal(p.Value, value) {
+		return fmt.Errorf("proof is of value %X, not %X", p.Value, value)
+	}
+	_, err := verifyExistence(root, p)
+	return err
+}
+
+// VerifyNonMembership checks that p proves key is absent from the tree with the given root hash.
+func VerifyNonMembership(root []byte, p *NonExistenceProof, key []byte) error {
+	if p == nil {
+		return errors.New("missing non-existence proof")
+	}
+	if !bytes.Equal(p.Key, key) {
+		return fmt.Errorf("proof is of key %X, not %X", p.Key, key)
+	}
+	if p.Left == nil && p.Right == nil {
+		if !bytes.Equal(root, EmptyHash) {
+			return errors.New("proof has no neighbours but the tree is not empty")
+		}
+		return nil
+	}
+
+	var leftPath, rightPath []innerNode
+	var err error
+	if p.Left != nil {
+		if leftPath, err = verifyExistence(root, p.Left); err != nil {
+			return fmt.Errorf("left neighbour, %w", err)
+		}
+		if bytes.Compare(p.Left.Key, key) >= 0 {
+			return errors.New("left neighbour is not below key")
+		}
+	}
+	if p.Right != nil {
+		if rightPath, err = verifyExistence(root, p.Right); err != nil {
+			return fmt.Errorf("right neighbour, %w", err)
+		}
+		if bytes.Compare(p.Right.Key, key) <= 0 {
+			return errors.New("right neighbour is not above key")
+		}
+	}
+
+	switch {
+	case p.Left == nil:
+		if !isEdge(rightPath, true) {
+			return errors.New("right neighbour is not the first leaf")
+		}
+	case p.Right == nil:
+		if !isEdge(leftPath, false) {
+			return errors.New("left neighbour is not the last leaf")
+		}
+	default:
+		if !areNeighbours(leftPath, rightPath) {
+			return errors.New("left and right neighbours are not adjacent")
+		}
+	}
+	return nil
+}
+
+// VerifyBatch checks that p proves each of pairs in the tree with the given root hash. A nil Value
+// claims the key is absent.
+func VerifyBatch(root []byte, p *BatchProof, pairs []KVPair) error {
+	if err := verifyBatchRoot(root, p); err != nil {
+		return err
+	}
+	for _, pair := range pairs {
+		value, err := p.Get(pair.Key)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(value, pair.Value) || (value == nil) != (pair.Value == nil) {
+			return fmt.Errorf("proof has value %X for key %X, not %X", value, pair.Key, pair.Value)
+		}
+	}
+	return nil
+}
+
+// VerifyRange checks that p proves pairs are all the keys in [start, end) of the tree with the given root
+// hash. A nil start or end leaves that side unbounded.
+func VerifyRange(root []byte, p *BatchProof, start, end []byte, pairs []KVPair) error {
+	if err := verifyBatchRoot(root, p); err != nil {
+		return err
+	}
+	proven, err := p.Range(start, end)
+	if err != nil {
+		return err
+	}
+	if len(proven) != len(pairs) {
+		return fmt.Errorf("proof has %d keys in range, not %d", len(proven), len(pairs))
+	}
+	for i := range pairs {
+		if !bytes.Equal(proven[i].Key, pairs[i].Key) || !bytes.Equal(proven[i].Value, pairs[i].Value) {
+			return fmt.Errorf("proof has key %X at %d of range, not %X", proven[i].Key, i, pairs[i].Key)
+		}
+	}
+	return nil
+}
+
+func verifyBatchRoot(root []byte, p *BatchProof) error {
+	if p == nil {
+		return errors.New("missing batch proof")
+	}
+	calculated, err := p.Calculate()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(calculated, root) {
+		return fmt.Errorf("proof root %X does not match %X", calculated, root)
+	}
+	return nil
+}
+
+// verifyExistence checks that the leaf and inner ops of p have the shape of IAVL nodes, so that a leaf
+// can't pass for an inner node or the other way round, and that p hashes to root. It returns the decoded
+// path.
+func verifyExistence(root []byte, p *ExistenceProof) ([]innerNode, error) {
+	if err := checkLeafOp(p.Leaf); err != nil {
+		return nil, err
+	}
+	path, err := parsePath(p.Path)
+	if err != nil {
+		return nil, err
+	}
+	calculated, err := p.Calculate()
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(calculated, root) {
+		return nil, fmt.Errorf("proof root %X does not match %X", calculated, root)
+	}
+	return path, nil
+}
+
+// checkLeafOp checks that op hashes leaves as IAVL does, so that a leaf can't pass for an inner node.
+func checkLeafOp(op *LeafOp) error {
+	if op == nil {
+		return errors.New("missing leaf op")
+	}
+	if op.Hash != HashOpSHA256 || op.PrehashKey != HashOpNoHash || op.PrehashValue != HashOpSHA256 ||
+		op.Length != LengthOpVarProto {
+		return errors.New("leaf op is not an IAVL leaf op")
+	}
+	height, size, _, rest, err := decodeNodePrefix(op.Prefix)
+	if err != nil {
+		return fmt.Errorf("leaf op prefix, %w", err)
+	}
+	if height != 0 || size != 1 || len(rest) != 0 {
+		return errors.New("leaf op prefix is not of an IAVL leaf")
+	}
+	return nil
+}
+
+// innerNode is an InnerOp decoded as an IAVL inner node.
+type innerNode struct {
+	height, size, version int64
+	// pathLeft is set if the child on the path is the left one.
+	pathLeft bool
+}
+
+// parsePath decodes the inner ops of an existence proof, from the parent of the leaf up to the root.
+func parsePath(path []*InnerOp) ([]innerNode, error) {
+	nodes := make([]innerNode, len(path))
+	for i, op := range path {
+		if op == nil || op.Hash != HashOpSHA256 {
+			return nil, fmt.Errorf("inner op %d is not an IAVL inner op", i)
+		}
+		height, size, version, rest, err := decodeNodePrefix(op.Prefix)
+		if err != nil {
+			return nil, fmt.Errorf("inner op %d prefix, %w", i, err)
+		}
+		// a parent is higher than its children.
+		if height <= 0 || size < 2 || (i > 0 && height <= nodes[i-1].height) {
+			return nil, fmt.Errorf("inner op %d prefix is not of an IAVL inner node", i)
+		}
+		node := innerNode{height: height, size: size, version: version}
+		switch {
+		case len(rest) == 1 && rest[0] == sha256.Size && len(op.Suffix) == 1+sha256.Size && op.Suffix[0] == sha256.Size:
+			node.pathLeft = true
+		case len(rest) == 2+sha256.Size && rest[0] == sha256.Size && rest[1+sha256.Size] == sha256.Size && len(op.Suffix) == 0:
+		default:
+			return nil, fmt.Errorf("inner op %d is not of an IAVL inner node", i)
+		}
+		nodes[i] = node
+	}
+	return nodes, nil
+}
+
+// isEdge reports whether path leads to the first leaf of the tree if left, or to the last one.
+func isEdge(path []innerNode, left bool) bool {
+	for _, node := range path {
+		if node.pathLeft != left {
+			return false
+		}
+	}
+	return true
+}
+
+// areNeighbours reports whether the paths of two leaves under the same root lead to adjacent leaves: they
+// share the nodes above the one where they part, left goes left there and then always right, and right
+// goes right and then always left.
+func areNeighbours(left, right []innerNode) bool {
+	// paths run up to the root, so the shared nodes are at their ends.
+	for len(left) > 0 && len(right) > 0 {
+		l, r := left[len(left)-1], right[len(right)-1]
+		if l.pathLeft != r.pathLeft {
+			break
+		}
+		left, right = left[:len(left)-1], right[:len(right)-1]
+	}
+	if len(left) == 0 || len(right) == 0 {
+		return false
+	}
+	l, r := left[len(left)-1], right[len(right)-1]
+	if !l.pathLeft || r.pathLeft || l.height != r.height || l.size != r.size || l.version != r.version {
+		return false
+	}
+	return isEdge(left[:len(left)-1], false) && isEdge(right[:len(right)-1], true)
+}
+
+// decodeNodePrefix reads the height, size and version of a node prefix and returns the bytes after them.
+func decodeNodePrefix(prefix []byte) (height, size, version int64, rest []byte, err error) {
+	var values [3]int64
+	for i := range values {
+		v, n := binary.Varint(prefix)
+		if n <= 0 {
+			return 0, 0, 0, nil, errors.New("invalid varint")
+		}
+		values[i] = v
+		prefix = prefix[n:]
+	}
+	if values[2] < 0 {
+		return 0, 0, 0, nil, errors.New("negative version")
+	}
+	return values[0], values[1], values[2], prefix, nil
+}
@@ -0,0 +1,148 @@
+package proof_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"math/rand"
+	"testing"
+
+	"github.com/kocubinski/iavlite/memiavl"
+	"github.com/kocubinski/iavlite/proof"
+	"github.com/kocubinski/iavlite/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func buildTree(t *testing.T) (*memiavl.Tree, [][]byte) {
+	tree := memiavl.NewEmptyTree(0, 0, 0)
+	return tree, testutil.BuildRandomTree(t, tree, 20, 50)
+}
+
+func TestVerifyMembership(t *testing.T) {
+	tree, keys := buildTree(t)
+	root := tree.RootHash()
+	for _, key := range keys {
+		p, err := tree.GetMembershipProof(key)
+		require.NoError(t, err)
+		require.NoError(t, proof.VerifyMembership(root, p, key, tree.Get(key)))
+	}
+
+	p, err := tree.GetMembershipProof(keys[0])
+	require.NoError(t, err)
+	require.Error(t, proof.VerifyMembership(root, p, keys[0], []byte("other value")))
+	require.Error(t, proof.VerifyMembership(root, p, keys[1], tree.Get(keys[0])))
+	require.Error(t, proof.VerifyMembership(tree.RootHash()[1:], p, keys[0], tree.Get(keys[0])))
+
+	// an inner node can't pass for a leaf.
+	inner := *p
+	inner.Path = p.Path[1:]
+	require.Error(t, proof.VerifyMembership(root, &inner, keys[0], tree.Get(keys[0])))
+}
+
+func TestVerifyMembership_ForgedLeafAsInner(t *testing.T) {
+	tree, _ := buildTree(t)
+
+	// the value of key is the leaf encoding of a fake pair, so its value hash is the hash of that fake
+	// leaf. Pretending the real leaf is an inner node above the fake leaf yields the real root.
+	fakeKey, fakeValue := []byte("fake key"), []byte("fake value")
+	fakeLeaf := proof.IavlLeafOp(1)
+	fakeValueHash := sha256.Sum256(fakeValue)
+	encoded := append(bytes.Clone(fakeLeaf.Prefix), byte(len(fakeKey)))
+	encoded = append(encoded, fakeKey...)
+	encoded = append(encoded, sha256.Size)
+	encoded = append(encoded, fakeValueHash[:]...)
+	key := []byte("key")
+	_, err := tree.Set(key, encoded)
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	root := tree.RootHash()
+
+	p, err := tree.GetMembershipProof(key)
+	require.NoError(t, err)
+	prefix := append(bytes.Clone(p.Leaf.Prefix), byte(len(key)))
+	prefix = append(prefix, key...)
+	prefix = append(prefix, sha256.Size)
+	forged := &proof.ExistenceProof{
+		Key:   fakeKey,
+		Value: fakeValue,
+		Leaf:  fakeLeaf,
+		Path:  append([]*proof.InnerOp{{Hash: proof.HashOpSHA256, Prefix: prefix}}, p.Path...),
+	}
+	calculated, err := forged.Calculate()
+	require.NoError(t, err)
+	require.Equal(t, root, []byte(calculated))
+	require.Error(t, proof.VerifyMembership(root, forged, fakeKey, fakeValue))
+}
+
+func TestVerifyNonMembership(t *testing.T) {
+	empty := memiavl.NewEmptyTree(0, 0, 0)
+	p, err := empty.GetNonMembershipProof([]byte("key"))
+	require.NoError(t, err)
+	require.NoError(t, proof.VerifyNonMembership(empty.RootHash(), p, []byte("key")))
+
+	tree, keys := buildTree(t)
+	root := tree.RootHash()
+	require.Error(t, proof.VerifyNonMembership(root, p, []byte("key")))
+
+	first, _ := tree.GetByIndex(0)
+	last, _ := tree.GetByIndex(tree.Size() - 1)
+	missing := [][]byte{{0x00}, append(bytes.Clone(last), 0x00)}
+	r := rand.New(rand.NewSource(4321))
+	for len(missing) < 200 {
+		key := make([]byte, 1+r.Intn(16))
+		r.Read(key)
+		if !tree.Has(key) {
+			missing = append(missing, key)
+		}
+	}
+	for _, key := range missing {
+		p, err := tree.GetNonMembershipProof(key)
+		require.NoError(t, err)
+		require.NoError(t, proof.VerifyNonMembership(root, p, key))
+	}
+
+	// neighbours which aren't adjacent don't prove absence of the keys between them.
+	left, err := tree.GetMembershipProof(first)
+	require.NoError(t, err)
+	right, err := tree.GetMembershipProof(last)
+	require.NoError(t, err)
+	between := append(bytes.Clone(first), 0x00)
+	require.Error(t, proof.VerifyNonMembership(root, &proof.NonExistenceProof{Key: between, Left: left, Right: right}, between))
+	require.Error(t, proof.VerifyNonMembership(root, &proof.NonExistenceProof{Key: between, Left: left}, between))
+	require.Error(t, proof.VerifyNonMembership(root, &proof.NonExistenceProof{Key: last, Left: left}, last))
+
+	// a present key can't be proven absent with its own leaf as a neighbour.
+	p, err = tree.GetNonMembershipProof(append(bytes.Clone(keys[0]), 0x00))
+	require.NoError(t, err)
+	if p.Left != nil {
+		require.Error(t, proof.VerifyNonMembership(root, &proof.NonExistenceProof{Key: p.Left.Key, Left: p.Left, Right: p.Right}, p.Left.Key))
+	}
+}
+
+func TestVerifyBatchAndRange(t *testing.T) {
+	tree, keys := buildTree(t)
+	root := tree.RootHash()
+
+	pairs := []proof.KVPair{{Key: keys[0], Value: tree.Get(keys[0])}, {Key: []byte("absent")}}
+	p, err := tree.GetBatchProof([][]byte{keys[0], []byte("absent")})
+	require.NoError(t, err)
+	require.NoError(t, proof.VerifyBatch(root, p, pairs))
+	require.Error(t, proof.VerifyBatch(root, p, []proof.KVPair{{Key: keys[0]}}))
+	require.Error(t, proof.VerifyBatch(root, p, []proof.KVPair{{Key: keys[1], Value: tree.Get(keys[1])}}))
+	require.Error(t, proof.VerifyBatch(root[1:], p, pairs))
+
+	start, end := []byte{0x40}, []byte{0x48}
+	p, err = tree.GetRangeProof(start, end)
+	require.NoError(t, err)
+	var expected []proof.KVPair
+	for i := int64(0); i < tree.Size(); i++ {
+		key, value := tree.GetByIndex(i)
+		if bytes.Compare(key, start) >= 0 && bytes.Compare(key, end) < 0 {
+			expected = append(expected, proof.KVPair{Key: key, Value: value})
+		}
+	}
+	require.NotEmpty(t, expected)
+	require.NoError(t, proof.VerifyRange(root, p, start, end, expected))
+	require.Error(t, proof.VerifyRange(root, p, start, end, expected[1:]))
+	require.Error(t, proof.VerifyRange(root, p, nil, end, expected))
+}
@@ -3,6 +3,7 @@ package testutil
 import (
 	"bytes"
 	"fmt"
+	"math/rand"
 	"testing"
 	"time"
 
@@ -82,6 +83,25 @@ type Tree interface {
 	Height() int8
 }
 
+// BuildRandomTree saves versions versions of tree, each setting leavesPerVersion random keys of 1 to 16
+// bytes to "value-<version>-<i>". The keys come from a fixed seed, and are returned in the order set.
+func BuildRandomTree(t *testing.T, tree Tree, versions, leavesPerVersion int) [][]byte {
+	r := rand.New(rand.NewSource(1234))
+	var keys [][]byte
+	for v := 0; v < versions; v++ {
+		for i := 0; i < leavesPerVersion; i++ {
+			key := make([]byte, 1+r.Intn(16))
+			r.Read(key)
+			_, err := tree.Set(key, []byte(fmt.Sprintf("value-%d-%d", v, i)))
+			require.NoError(t, err)
+			keys = append(keys, key)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	return keys
+}
+
 func TestTreeBuild(t *testing.T, opts TreeBuildOptions) {
 	tree := opts.Tree
 
@@ -0,0 +1,93 @@
+package v3
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/DataDog/zstd"
+	"github.com/golang/snappy"
+)
+
+// Codec is the compression of the changesets in WAL records. Each record is tagged with the codec it was
+// written with, so the codec may change between restarts.
+type Codec byte
+
+const (
+	CodecNone Codec = iota
+	CodecSnappy
+	CodecZstd
+)
+
+func (c Codec) String() string {
+	switch c {
+	case CodecNone:
+		return "none"
+	case CodecSnappy:
+		return "snappy"
+	case CodecZstd:
+		return "zstd"
+	default:
+		return fmt.Sprintf("codec(%d)", byte(c))
+	}
+}
+
+func (c Codec) encode(bz []byte) ([]byte, error) {
+	switch c {
+	case CodecNone:
+		return bz, nil
+	case CodecSnappy:
+		return snappy.Encode(nil, bz), nil
+	case CodecZstd:
+		return zstd.Compress(nil, bz)
+	default:
+		return nil, fmt.Errorf("unknown wal codec %s", c)
+	}
+}
+
+func (c Codec) decode(bz []byte) ([]byte, error) {
+	switch c {
+	case CodecNone:
+		return bz, nil
+	case CodecSnappy:
+		return snappy.Decode(nil, bz)
+	case CodecZstd:
+		return zstd.Decompress(nil, bz)
+	default:
+		return nil, fmt.Errorf("unknown wal codec %s", c)
+	}
+}
+
+// SetCodec sets the codec changesets are compressed with in the records written from now on.
+func (r *Wal) SetCodec(codec Codec) error {
+	if _, err := codec.encode(nil); err != nil {
+		return err
+	}
+	r.codec = codec
+	return nil
+}
+
+// appendRecord compresses the changeset of version with the codec of the log and frames it as a record
+// at the end of buf, updating the compression metrics.
+func (r *Wal) appendRecord(buf *bytes.Buffer, version int64, changeset []byte) error {
+	stored, err := r.codec.encode(changeset)
+	if err != nil {
+		return err
+	}
+	appendWalRecord(buf, version, r.codec, stored)
+
+	r.rawBytes += int64(len(changeset))
+	r.storedBytes += int64(len(stored))
+	if r.MetricCompressionRatio != nil && r.storedBytes > 0 {
+		r.MetricCompressionRatio.Set(float64(r.rawBytes) / float64(r.storedBytes))
+	}
+	return nil
+}
+
+// CompressionRatio returns the ratio of the size of the changesets written to the log to the size they
+// were stored in, since the log was opened.
+func (r *Wal) CompressionRatio() float64 {
+	if r.storedBytes == 0 {
+		return 1
+	}
+	return float64(r.rawBytes) / float64(r.storedBytes)
+}
@@ -24,6 +24,8 @@ type NodeDb interface {
 
 var _ NodeDb = (*KeyValueBackend)(nil)
 
+const defaultWalFlushSize = 50 * 1024 * 1024
+
 type KeyValueBackend struct {
 	nodes   []*Node
 	orphans []*Node
@@ -32,6 +34,11 @@ type KeyValueBackend struct {
 	wal     *Wal
 	walIdx  uint64
 
+	// walFlushSize is the size walBuf grows to before it is written to the log.
+	walFlushSize int
+	// recoveredVersion is the last version replayed from the log on startup.
+	recoveredVersion int64
+
 	// metrics
 	MetricBlockCount      CountMetric
 	MetricCacheSize       GaugeMetric
@@ -41,23 +48,34 @@ type KeyValueBackend struct {
 	MetricDbFetchDuration HistogramMetric
 }
 
+// NewKeyValueBackend returns a backend writing to wal, first replaying into its cache the changesets
+// logged since the last checkpoint, which would otherwise be lost from commitment after a crash.
 func NewKeyValueBackend(db dbm.DB, wal *Wal) (*KeyValueBackend, error) {
-	walIdx, err := wal.FirstIndex()
+	recoveredVersion, err := wal.Recover()
 	if err != nil {
 		return nil, err
 	}
-	if walIdx == 0 {
-		walIdx = 1
+	lastIdx, err := wal.LastIndex()
+	if err != nil {
+		return nil, err
 	}
 
 	return &KeyValueBackend{
-		db:     db,
-		wal:    wal,
-		walIdx: walIdx,
-		walBuf: new(bytes.Buffer),
+		db:               db,
+		wal:              wal,
+		walIdx:           lastIdx + 1,
+		walBuf:           new(bytes.Buffer),
+		walFlushSize:     defaultWalFlushSize,
+		recoveredVersion: recoveredVersion,
 	}, nil
 }
 
+// RecoveredVersion returns the last version replayed from the log when the backend was created, or 0 if
+// there was nothing to replay.
+func (kv *KeyValueBackend) RecoveredVersion() int64 {
+	return kv.recoveredVersion
+}
+
 func (kv *KeyValueBackend) QueueNode(node *Node) error {
 	if node.nodeKey == nil {
 		return fmt.Errorf("empty node key")
@@ -75,20 +93,30 @@ func (kv *KeyValueBackend) QueueOrphan(node *Node) error {
 }
 
 func (kv *KeyValueBackend) Commit(version int64) error {
+	if err := kv.wal.CheckpointErr(); err != nil {
+		return err
+	}
 	var nk nodeCacheKey
 
+	// the changeset holds the changes to commitment, so that they can be replayed from the log.
 	changeset := &ChangeSet{}
 	for _, node := range kv.nodes {
-		changeset.Pairs = append(changeset.Pairs, &KVPair{Key: node.key, Value: node.value})
+		nodeBz := new(bytes.Buffer)
+		if err := node.writeBytes(nodeBz); err != nil {
+			return err
+		}
+		nodeKey := node.nodeKey.GetKey()
+		changeset.Pairs = append(changeset.Pairs, &KVPair{Key: nodeKey, Value: nodeBz.Bytes()})
 
-		copy(nk[:], node.nodeKey.GetKey())
+		copy(nk[:], nodeKey)
 		dn := &deferredNode{nodeKey: nk, node: node}
 		kv.wal.CachePut(dn)
 	}
 
 	for _, node := range kv.orphans {
-		copy(nk[:], node.nodeKey.GetKey())
-		changeset.Pairs = append(changeset.Pairs, &KVPair{Key: node.key, Value: node.value, Delete: true})
+		nodeKey := node.nodeKey.GetKey()
+		copy(nk[:], nodeKey)
+		changeset.Pairs = append(changeset.Pairs, &KVPair{Key: nodeKey, Delete: true})
 		dn := &deferredNode{nodeKey: nk, deleted: true, node: node}
 		kv.wal.CachePut(dn)
 	}
@@ -97,20 +125,20 @@ func (kv *KeyValueBackend) Commit(version int64) error {
 	if err != nil {
 		return err
 	}
-	kv.walBuf.Write(walBz)
+	if err := kv.wal.appendRecord(kv.walBuf, version, walBz); err != nil {
+		return err
+	}
 
-	if kv.walBuf.Len() > 50*1024*1024 {
+	if kv.walBuf.Len() > kv.walFlushSize || kv.wal.writesEveryVersion() {
 		err = kv.wal.Write(kv.walIdx, kv.walBuf.Bytes())
 		if err != nil {
 			return err
 		}
-		// TODO: support single threaded checkpoint by configuration
+		// checkpoints run in the background while the wal's CheckpointRunner does.
 		err = kv.wal.MaybeCheckpoint(kv.walIdx, version)
 		if err != nil {
 			return err
 		}
-		// ASYNC checkpoint
-		//kv.wal.checkpointCh <- &checkpointArgs{kv.walIdx, version, kv.nodeCache}
 		kv.walBuf.Reset()
 		kv.walIdx++
 	}
@@ -0,0 +1,154 @@
+package v3
+
+import (
+	"errors"
+	"time"
+)
+
+// SyncMode is how often the log is synced to disk, trading commit latency for the versions which may be
+// lost in a crash.
+type SyncMode int
+
+const (
+	// SyncNone leaves syncing to the OS. Changesets are buffered and written to the log in large entries.
+	SyncNone SyncMode = iota
+	// SyncEveryWrite syncs the changeset of every version before Commit returns.
+	SyncEveryWrite
+	// SyncEveryVersions syncs once every Durability.Versions versions.
+	SyncEveryVersions
+	// SyncInterval syncs the versions written in each Durability.Interval together, in the background.
+	SyncInterval
+)
+
+// Durability configures when the log is synced. In every mode but SyncNone the changeset of each version
+// is written to the log when it is committed. Checkpoints follow the bytes written to the log, so they are
+// as frequent in every mode.
+type Durability struct {
+	Mode     SyncMode
+	Versions int
+	Interval time.Duration
+}
+
+// SetDurability sets the durability of the log, stopping the background sync of a previous SyncInterval.
+func (r *Wal) SetDurability(d Durability) error {
+	switch d.Mode {
+	case SyncNone, SyncEveryWrite:
+	case SyncEveryVersions:
+		if d.Versions <= 0 {
+			return errors.New("wal: sync every versions needs a positive version count")
+		}
+	case SyncInterval:
+		if d.Interval <= 0 {
+			return errors.New("wal: sync interval needs a positive interval")
+		}
+	default:
+		return errors.New("wal: unknown sync mode")
+	}
+
+	if err := r.stopSyncer(); err != nil {
+		return err
+	}
+	r.durability = d
+	if d.Mode == SyncInterval {
+		r.syncStop = make(chan struct{})
+		r.syncDone = make(chan struct{})
+		go r.syncer(d.Interval, r.syncStop, r.syncDone)
+	}
+	return nil
+}
+
+// writesEveryVersion reports whether the changeset of every version must be written to the log when it is
+// committed, rather than buffered.
+func (r *Wal) writesEveryVersion() bool {
+	return r.durability.Mode != SyncNone
+}
+
+// afterWrite syncs the log if the durability calls for it after a write.
+func (r *Wal) afterWrite() error {
+	r.syncLock.Lock()
+	r.unsynced++
+	unsynced := r.unsynced
+	r.syncLock.Unlock()
+
+	switch r.durability.Mode {
+	case SyncEveryWrite:
+		return r.Sync()
+	case SyncEveryVersions:
+		if unsynced >= r.durability.Versions {
+			return r.Sync()
+		}
+	}
+	return nil
+}
+
+// Sync syncs the log to disk, observing its latency in MetricSyncDuration.
+func (r *Wal) Sync() error {
+	r.syncLock.Lock()
+	defer r.syncLock.Unlock()
+	since := time.Now()
+	if err := r.wal.Sync(); err != nil {
+		return err
+	}
+	if r.MetricSyncDuration != nil {
+		r.MetricSyncDuration.Observe(time.Since(since).Seconds())
+	}
+	r.unsynced = 0
+	return nil
+}
+
+func (r *Wal) syncer(interval time.Duration, stop, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			r.syncLock.Lock()
+			dirty := r.unsynced > 0
+			r.syncLock.Unlock()
+			if !dirty {
+				continue
+			}
+			if err := r.Sync(); err != nil {
+				r.syncLock.Lock()
+				r.syncErr = err
+				r.syncLock.Unlock()
+				return
+			}
+		}
+	}
+}
+
+// stopSyncer stops the background sync, if running, and syncs what it has not yet. It returns an error
+// the background sync failed with.
+func (r *Wal) stopSyncer() error {
+	if r.syncStop == nil {
+		return nil
+	}
+	close(r.syncStop)
+	<-r.syncDone
+	r.syncStop, r.syncDone = nil, nil
+
+	r.syncLock.Lock()
+	err := r.syncErr
+	r.syncErr = nil
+	r.syncLock.Unlock()
+	if err != nil {
+		return err
+	}
+	return r.Sync()
+}
+
+// syncError returns the error the background sync failed with, if any.
+func (r *Wal) syncError() error {
+	r.syncLock.Lock()
+	defer r.syncLock.Unlock()
+	return r.syncErr
+}
+
+// Close stops the background sync of SyncInterval and syncs the log. The log itself is left open.
+func (r *Wal) Close() error {
+	return r.stopSyncer()
+}
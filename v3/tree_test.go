@@ -1,9 +1,22 @@
 package v3
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
+	dbm "github.com/cosmos/cosmos-db"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
 	"github.com/kocubinski/iavlite/testutil"
+	"github.com/stretchr/testify/require"
 )
 
 func TestTree_Build(t *testing.T) {
@@ -13,3 +26,534 @@ func TestTree_Build(t *testing.T) {
 	opts := testutil.NewTreeBuildOptions(tree).With1_500_000()
 	testutil.TestTreeBuild(t, opts)
 }
+
+// commitLeaves commits versions [from, to] to kv, each setting a leaf which replaces that of the previous
+// version.
+func commitLeaves(t *testing.T, kv *KeyValueBackend, from, to int64) {
+	for version := from; version <= to; version++ {
+		node := NewNode(&NodeKey{version: version, nonce: 1}, []byte("key"), []byte(fmt.Sprintf("value-%d", version)))
+		node._hash(version)
+		require.NoError(t, kv.QueueNode(node))
+		if version > 1 {
+			require.NoError(t, kv.QueueOrphan(&Node{nodeKey: &NodeKey{version: version - 1, nonce: 1}, key: []byte("key")}))
+		}
+		require.NoError(t, kv.Commit(version))
+	}
+}
+
+func TestWal_Recover(t *testing.T) {
+	dir := t.TempDir()
+	commitment := dbm.NewMemDB()
+
+	log, err := NewTidwalLog(dir)
+	require.NoError(t, err)
+	wal := NewWal(log, commitment)
+	kv, err := NewKeyValueBackend(commitment, wal)
+	require.NoError(t, err)
+	require.Zero(t, kv.RecoveredVersion())
+	// write every commit to the log, checkpointing each up to version 11.
+	kv.walFlushSize = 0
+	wal.checkpointSize = 1
+	commitLeaves(t, kv, 1, 11)
+	wal.checkpointSize = defaultCheckpointSize
+	commitLeaves(t, kv, 12, 15)
+	has, err := commitment.Has(GetRootKey(11))
+	require.NoError(t, err)
+	require.True(t, has)
+	has, err = commitment.Has(GetRootKey(15))
+	require.NoError(t, err)
+	require.False(t, has)
+	require.NoError(t, log.Close())
+
+	// versions after the checkpoint are lost from commitment until the log is replayed.
+	log, err = NewTidwalLog(dir)
+	require.NoError(t, err)
+	defer log.Close()
+	wal = NewWal(log, commitment)
+	kv, err = NewKeyValueBackend(commitment, wal)
+	require.NoError(t, err)
+	require.Equal(t, int64(15), kv.RecoveredVersion())
+
+	var nk nodeCacheKey
+	copy(nk[:], GetRootKey(15))
+	node, err := wal.CacheGet(nk)
+	require.NoError(t, err)
+	require.NotNil(t, node)
+	require.Equal(t, []byte("value-15"), node.value)
+	copy(nk[:], GetRootKey(14))
+	node, err = wal.CacheGet(nk)
+	require.NoError(t, err)
+	require.Nil(t, node)
+
+	// the backend appends after the replayed entries.
+	commitLeaves(t, kv, 16, 16)
+	lastIdx, err := wal.LastIndex()
+	require.NoError(t, err)
+	require.NoError(t, wal.Checkpoint(lastIdx, 16))
+	for version := int64(1); version <= 16; version++ {
+		has, err := commitment.Has(GetRootKey(version))
+		require.NoError(t, err)
+		require.Equal(t, version == 16, has, "version %d", version)
+	}
+	value, err := commitment.Get(GetRootKey(16))
+	require.NoError(t, err)
+	node, err = MakeNode(GetRootKey(16), value)
+	require.NoError(t, err)
+	require.Equal(t, []byte("value-16"), node.value)
+}
+
+func TestWal_TornRecord(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// tear corrupts the encoding of a record.
+		tear func(record []byte) []byte
+		// onlyEntry puts the damaged entry first in the log.
+		onlyEntry bool
+	}{
+		{name: "torn header", tear: func(record []byte) []byte { return record[:walRecordHeaderSize-1] }},
+		{name: "torn changeset", tear: func(record []byte) []byte { return record[:len(record)-1] }},
+		{name: "checksum", tear: func(record []byte) []byte { record[len(record)-1] ^= 0xff; return record }},
+		{name: "first entry", tear: func(record []byte) []byte { return record[:len(record)-1] }, onlyEntry: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			commitment := dbm.NewMemDB()
+			log, err := NewTidwalLog(dir)
+			require.NoError(t, err)
+			kv, err := NewKeyValueBackend(commitment, NewWal(log, commitment))
+			require.NoError(t, err)
+			kv.walFlushSize = 0
+			last := int64(0)
+			if !tc.onlyEntry {
+				last = 5
+				commitLeaves(t, kv, 1, last)
+			}
+
+			// an entry with a good record of the next version, then a damaged one.
+			entry := new(bytes.Buffer)
+			appendWalRecord(entry, last+1, CodecNone, []byte{})
+			good := entry.Len()
+			damaged := new(bytes.Buffer)
+			appendWalRecord(damaged, last+2, CodecNone, []byte("changeset"))
+			entry.Write(tc.tear(damaged.Bytes()))
+			lastIdx, err := log.LastIndex()
+			require.NoError(t, err)
+			require.NoError(t, log.Write(lastIdx+1, entry.Bytes()))
+			require.NoError(t, log.Close())
+
+			log, err = NewTidwalLog(dir)
+			require.NoError(t, err)
+			defer log.Close()
+			wal := NewWal(log, commitment)
+			kv, err = NewKeyValueBackend(commitment, wal)
+			require.NoError(t, err)
+			require.Equal(t, last+1, kv.RecoveredVersion())
+			require.ErrorIs(t, wal.TornRecord(), errTornRecord)
+
+			// the damaged record is truncated away, and the log ends with the good one.
+			lastIdx, err = log.LastIndex()
+			require.NoError(t, err)
+			bz, err := log.Read(lastIdx)
+			require.NoError(t, err)
+			require.Len(t, bz, good)
+			records, _, err := readWalRecords(bz)
+			require.NoError(t, err)
+			require.Len(t, records, 1)
+			require.Equal(t, last+1, records[0].version)
+
+			// commits append after the truncated log, and replay again.
+			kv.walFlushSize = 0
+			commitLeaves(t, kv, last+2, last+2)
+			require.NoError(t, log.Close())
+			log, err = NewTidwalLog(dir)
+			require.NoError(t, err)
+			defer log.Close()
+			wal = NewWal(log, commitment)
+			kv, err = NewKeyValueBackend(commitment, wal)
+			require.NoError(t, err)
+			require.Equal(t, last+2, kv.RecoveredVersion())
+			require.NoError(t, wal.TornRecord())
+		})
+	}
+}
+
+func TestWal_UnreadableRecord(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// damage makes a record unreadable other than by tearing it.
+		damage func(record []byte) []byte
+		// middle puts the damaged entry before the last one.
+		middle bool
+	}{
+		{name: "format version", damage: func(record []byte) []byte { record[4] = 0xff; return record }},
+		{name: "magic", damage: func(record []byte) []byte { record[0] ^= 0xff; return record }},
+		{name: "torn before last entry", damage: func(record []byte) []byte { return record[:len(record)-1] }, middle: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			commitment := dbm.NewMemDB()
+			log, err := NewTidwalLog(dir)
+			require.NoError(t, err)
+			kv, err := NewKeyValueBackend(commitment, NewWal(log, commitment))
+			require.NoError(t, err)
+			kv.walFlushSize = 0
+			commitLeaves(t, kv, 1, 5)
+
+			damaged := new(bytes.Buffer)
+			appendWalRecord(damaged, 6, CodecNone, []byte("changeset"))
+			lastIdx, err := log.LastIndex()
+			require.NoError(t, err)
+			require.NoError(t, log.Write(lastIdx+1, tc.damage(damaged.Bytes())))
+			if tc.middle {
+				kv.walIdx = lastIdx + 2
+				commitLeaves(t, kv, 7, 7)
+			}
+			lastIdx, err = log.LastIndex()
+			require.NoError(t, err)
+			require.NoError(t, log.Close())
+
+			// recovery fails rather than dropping the entries from the damaged one on.
+			log, err = NewTidwalLog(dir)
+			require.NoError(t, err)
+			defer log.Close()
+			_, err = NewKeyValueBackend(commitment, NewWal(log, commitment))
+			require.Error(t, err)
+			require.Equal(t, tc.middle, errors.Is(err, errTornRecord))
+			after, err := log.LastIndex()
+			require.NoError(t, err)
+			require.Equal(t, lastIdx, after)
+		})
+	}
+}
+
+func TestWal_TornSegment(t *testing.T) {
+	dir := t.TempDir()
+	commitment := dbm.NewMemDB()
+	log, err := NewTidwalLog(dir)
+	require.NoError(t, err)
+	kv, err := NewKeyValueBackend(commitment, NewWal(log, commitment))
+	require.NoError(t, err)
+	kv.walFlushSize = 0
+	commitLeaves(t, kv, 1, 5)
+	require.NoError(t, log.Close())
+
+	// a crash while writing the last entry leaves it cut short in the segment file.
+	segment := filepath.Join(dir, "iavl.wal", fmt.Sprintf("%020d", 1))
+	info, err := os.Stat(segment)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(segment, info.Size()-3))
+
+	log, torn, err := OpenTidwalLog(dir)
+	require.NoError(t, err)
+	defer log.Close()
+	require.NotNil(t, torn)
+	require.Equal(t, segment, torn.Path)
+	require.Less(t, torn.Size, info.Size()-3)
+	lastIdx, err := log.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), lastIdx)
+	kv, err = NewKeyValueBackend(commitment, NewWal(log, commitment))
+	require.NoError(t, err)
+	require.Equal(t, int64(4), kv.RecoveredVersion())
+
+	// the torn version is committed again after the truncated log.
+	kv.walFlushSize = 0
+	commitLeaves(t, kv, 5, 5)
+	lastIdx, err = log.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), lastIdx)
+}
+
+type syncHistogram struct {
+	mu    sync.Mutex
+	count int
+}
+
+func (h *syncHistogram) Observe(float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.count++
+}
+
+func (h *syncHistogram) syncs() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count
+}
+
+func TestWal_Durability(t *testing.T) {
+	cases := []struct {
+		name       string
+		durability Durability
+		// syncs is the number of syncs after committing 7 versions, before Close.
+		syncs int
+	}{
+		{name: "none", durability: Durability{Mode: SyncNone}, syncs: 0},
+		{name: "every write", durability: Durability{Mode: SyncEveryWrite}, syncs: 7},
+		{name: "every versions", durability: Durability{Mode: SyncEveryVersions, Versions: 3}, syncs: 2},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			log, err := NewTidwalLog(t.TempDir())
+			require.NoError(t, err)
+			defer log.Close()
+			commitment := dbm.NewMemDB()
+			wal := NewWal(log, commitment)
+			metric := &syncHistogram{}
+			wal.MetricSyncDuration = metric
+			require.NoError(t, wal.SetDurability(tc.durability))
+			kv, err := NewKeyValueBackend(commitment, wal)
+			require.NoError(t, err)
+
+			commitLeaves(t, kv, 1, 7)
+			require.Equal(t, tc.syncs, metric.syncs())
+			lastIdx, err := wal.LastIndex()
+			require.NoError(t, err)
+			if tc.durability.Mode == SyncNone {
+				// buffered until the flush size is reached.
+				require.Zero(t, lastIdx)
+			} else {
+				require.Equal(t, uint64(7), lastIdx)
+			}
+			require.NoError(t, wal.Close())
+		})
+	}
+
+	t.Run("interval", func(t *testing.T) {
+		log, err := NewTidwalLog(t.TempDir())
+		require.NoError(t, err)
+		defer log.Close()
+		commitment := dbm.NewMemDB()
+		wal := NewWal(log, commitment)
+		metric := &syncHistogram{}
+		wal.MetricSyncDuration = metric
+		require.NoError(t, wal.SetDurability(Durability{Mode: SyncInterval, Interval: 50 * time.Millisecond}))
+		kv, err := NewKeyValueBackend(commitment, wal)
+		require.NoError(t, err)
+
+		commitLeaves(t, kv, 1, 7)
+		require.Eventually(t, func() bool { return metric.syncs() > 0 }, 2*time.Second, time.Millisecond)
+		// versions written together are synced together.
+		require.Less(t, metric.syncs(), 7)
+		require.NoError(t, wal.Close())
+		require.NoError(t, wal.Close())
+	})
+
+	wal := NewWal(nil, nil)
+	require.Error(t, wal.SetDurability(Durability{Mode: SyncEveryVersions}))
+	require.Error(t, wal.SetDurability(Durability{Mode: SyncInterval}))
+	require.Error(t, wal.SetDurability(Durability{Mode: SyncMode(-1)}))
+}
+
+func TestWal_CheckpointCadence(t *testing.T) {
+	// checkpoints follow the bytes written to the log, not the entries which hold them, so buffering
+	// versions into large entries or writing one entry per version checkpoints about as often.
+	checkpoints := make(map[SyncMode]int)
+	for _, durability := range []Durability{{Mode: SyncNone}, {Mode: SyncEveryVersions, Versions: 100}} {
+		log, err := NewTidwalLog(t.TempDir())
+		require.NoError(t, err)
+		commitment := dbm.NewMemDB()
+		wal := NewWal(log, commitment)
+		require.NoError(t, wal.SetDurability(durability))
+		kv, err := NewKeyValueBackend(commitment, wal)
+		require.NoError(t, err)
+		kv.walFlushSize = 1024
+		wal.checkpointSize = 8 * 1024
+
+		for version := int64(1); version <= 500; version++ {
+			commitLeaves(t, kv, version, version)
+			select {
+			case <-wal.CheckpointSignal:
+				checkpoints[durability.Mode]++
+			default:
+			}
+		}
+		require.NoError(t, wal.Close())
+		require.NoError(t, log.Close())
+	}
+	require.Greater(t, checkpoints[SyncNone], 1)
+	require.InDelta(t, checkpoints[SyncNone], checkpoints[SyncEveryVersions], 1)
+}
+
+// blockingDB blocks writes until release is closed, then fails them with err if set.
+type blockingDB struct {
+	dbm.DB
+	release chan struct{}
+	err     error
+}
+
+func (db *blockingDB) Set(key, value []byte) error {
+	<-db.release
+	if db.err != nil {
+		return db.err
+	}
+	return db.DB.Set(key, value)
+}
+
+func TestWal_CheckpointRunner(t *testing.T) {
+	log, err := NewTidwalLog(t.TempDir())
+	require.NoError(t, err)
+	defer log.Close()
+	commitment := &blockingDB{DB: dbm.NewMemDB(), release: make(chan struct{})}
+	wal := NewWal(log, commitment)
+	wal.checkpointSize = 1
+	kv, err := NewKeyValueBackend(commitment, wal)
+	require.NoError(t, err)
+	kv.walFlushSize = 0
+
+	ctx, cancel := context.WithCancel(context.Background())
+	runnerErr := make(chan error)
+	go func() { runnerErr <- wal.CheckpointRunner(ctx) }()
+	require.Eventually(t, func() bool {
+		wal.cacheLock.RLock()
+		defer wal.cacheLock.RUnlock()
+		return wal.runnerDone != nil
+	}, time.Second, time.Millisecond)
+	require.Error(t, wal.CheckpointRunner(ctx))
+
+	// with the first checkpoint stuck in commitment, commits fill the queue and then block.
+	committed := make(chan struct{})
+	go func() {
+		defer close(committed)
+		commitLeaves(t, kv, 1, 12)
+	}()
+	select {
+	case <-committed:
+		t.Fatal("commit did not block on a full checkpoint queue")
+	case <-time.After(100 * time.Millisecond):
+	}
+	// queued nodes are read from the caches while their checkpoint is in flight.
+	var nk nodeCacheKey
+	copy(nk[:], GetRootKey(3))
+	node, err := wal.CacheGet(nk)
+	require.NoError(t, err)
+	require.NotNil(t, node)
+
+	close(commitment.release)
+	<-committed
+	commitLeaves(t, kv, 13, 19)
+	wal.checkpointSize = defaultCheckpointSize
+	commitLeaves(t, kv, 20, 20)
+
+	// cancellation flushes the checkpoints still queued, and then version 20, still unflushed in the hot
+	// cache.
+	cancel()
+	require.ErrorIs(t, <-runnerErr, context.Canceled)
+	require.Empty(t, wal.pending)
+	require.Empty(t, wal.hotCache.puts)
+	// the last checkpoint was at version 20, which replaced the leaves of earlier versions.
+	for version := int64(1); version <= 20; version++ {
+		has, err := commitment.Has(GetRootKey(version))
+		require.NoError(t, err)
+		require.Equal(t, version == 20, has, "version %d", version)
+	}
+
+	// a failed background checkpoint is returned by Commit.
+	commitment.err = errors.New("commitment failed")
+	wal.checkpointSize = 1
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go func() { runnerErr <- wal.CheckpointRunner(ctx) }()
+	require.Eventually(t, func() bool {
+		wal.cacheLock.RLock()
+		defer wal.cacheLock.RUnlock()
+		return wal.runnerDone != nil
+	}, time.Second, time.Millisecond)
+	var commitErr error
+	for version := int64(21); version < 40 && commitErr == nil; version++ {
+		node := NewNode(&NodeKey{version: version, nonce: 1}, []byte("key"), []byte("value"))
+		node._hash(version)
+		require.NoError(t, kv.QueueNode(node))
+		commitErr = kv.Commit(version)
+	}
+	require.ErrorIs(t, <-runnerErr, commitment.err)
+	if commitErr == nil {
+		commitErr = kv.Commit(40)
+	}
+	require.ErrorIs(t, commitErr, commitment.err)
+}
+
+type ratioGauge struct {
+	value float64
+}
+
+func (g *ratioGauge) Add(v float64) { g.value += v }
+
+func (g *ratioGauge) Sub(v float64) { g.value -= v }
+
+func (g *ratioGauge) Set(v float64) { g.value = v }
+
+func TestWal_Codec(t *testing.T) {
+	dir := t.TempDir()
+	commitment := dbm.NewMemDB()
+	version := int64(0)
+	for _, codec := range []Codec{CodecNone, CodecSnappy, CodecZstd} {
+		log, err := NewTidwalLog(dir)
+		require.NoError(t, err)
+		wal := NewWal(log, commitment)
+		gauge := &ratioGauge{}
+		wal.MetricCompressionRatio = gauge
+		require.NoError(t, wal.SetCodec(codec))
+		// records written with the previous codecs are decoded by theirs.
+		kv, err := NewKeyValueBackend(commitment, wal)
+		require.NoError(t, err)
+		require.Equal(t, version, kv.RecoveredVersion())
+		kv.walFlushSize = 0
+		wal.checkpointSize = defaultCheckpointSize
+
+		// values large and repetitive enough to compress despite the node hashes.
+		for i := 0; i < 5; i++ {
+			version++
+			value := bytes.Repeat([]byte(fmt.Sprintf("value-%d", version)), 64)
+			node := NewNode(&NodeKey{version: version, nonce: 1}, []byte("key"), value)
+			node._hash(version)
+			require.NoError(t, kv.QueueNode(node))
+			require.NoError(t, kv.Commit(version))
+		}
+		require.Equal(t, wal.CompressionRatio(), gauge.value)
+		if codec == CodecNone {
+			require.Equal(t, 1.0, wal.CompressionRatio())
+		} else {
+			require.Greater(t, wal.CompressionRatio(), 1.0, "codec %s", codec)
+		}
+
+		lastIdx, err := log.LastIndex()
+		require.NoError(t, err)
+		bz, err := log.Read(lastIdx)
+		require.NoError(t, err)
+		records, _, err := readWalRecords(bz)
+		require.NoError(t, err)
+		require.Len(t, records, 1)
+		require.Equal(t, codec, records[0].codec)
+		require.NoError(t, log.Close())
+	}
+
+	log, err := NewTidwalLog(dir)
+	require.NoError(t, err)
+	defer log.Close()
+	wal := NewWal(log, commitment)
+	kv, err := NewKeyValueBackend(commitment, wal)
+	require.NoError(t, err)
+	require.Equal(t, version, kv.RecoveredVersion())
+	var nk nodeCacheKey
+	copy(nk[:], GetRootKey(version))
+	node, err := wal.CacheGet(nk)
+	require.NoError(t, err)
+	require.Equal(t, bytes.Repeat([]byte(fmt.Sprintf("value-%d", version)), 64), node.value)
+
+	require.Error(t, wal.SetCodec(Codec(42)))
+}
+
+func TestWal_CompressedRecordOldReader(t *testing.T) {
+	changeset, err := proto.Marshal(&ChangeSet{Pairs: []*KVPair{{Key: []byte("key"), Value: []byte("value")}}})
+	require.NoError(t, err)
+	entry := new(bytes.Buffer)
+	appendWalRecord(entry, 1, CodecSnappy, snappy.Encode(nil, changeset))
+
+	// a release which predates compression reads the record as uncompressed, and fails to decode it.
+	header := entry.Bytes()[:walRecordHeaderSize]
+	require.Equal(t, byte(1), header[4])
+	length := binary.BigEndian.Uint32(header[13:])
+	stored := entry.Bytes()[walRecordHeaderSize : walRecordHeaderSize+int(length)]
+	require.Error(t, proto.Unmarshal(stored, &ChangeSet{}))
+}
@@ -3,7 +3,13 @@ package v3
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -48,12 +54,85 @@ func (w *WalNode) String() string { return "" }
 
 func (w *WalNode) ProtoMessage() {}
 
+// NewTidwalLog opens the log in logDir like OpenTidwalLog, dropping the details of a torn segment.
 func NewTidwalLog(logDir string) (*wal.Log, error) {
+	log, _, err := OpenTidwalLog(logDir)
+	return log, err
+}
+
+// TornSegment is the last segment of the log, truncated on open to its complete entries.
+type TornSegment struct {
+	Path string
+	// Size is the size of the segment after the truncation, the offset of the torn entry.
+	Size int64
+}
+
+// OpenTidwalLog opens the log in logDir. A crash may leave the last entry of the last segment partly
+// written, which the log refuses to open; that segment is then truncated to its complete entries and
+// returned.
+func OpenTidwalLog(logDir string) (*wal.Log, *TornSegment, error) {
 	walOpts := wal.DefaultOptions
+	// syncs are made by Wal according to its Durability.
 	walOpts.NoSync = true
 	walOpts.NoCopy = true
-	log, err := wal.Open(fmt.Sprintf("%s/iavl.wal", logDir), walOpts)
-	return log, err
+	path := fmt.Sprintf("%s/iavl.wal", logDir)
+	log, err := wal.Open(path, walOpts)
+	if !errors.Is(err, wal.ErrCorrupt) {
+		return log, nil, err
+	}
+	torn, err := truncateTornSegment(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	log, err = wal.Open(path, walOpts)
+	if err != nil {
+		return nil, nil, err
+	}
+	return log, torn, nil
+}
+
+// truncateTornSegment truncates the last segment of the tidwall log at path to its complete entries. An
+// entry is written as uvarint(len(data)) || data.
+func truncateTornSegment(path string) (*TornSegment, error) {
+	fis, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var segment string
+	for _, fi := range fis {
+		// segments are named by their first index, zero padded to 20 digits.
+		name := fi.Name()
+		if fi.IsDir() || len(name) != 20 || strings.Trim(name, "0123456789") != "" {
+			continue
+		}
+		if name > segment {
+			segment = name
+		}
+	}
+	if segment == "" {
+		return nil, wal.ErrCorrupt
+	}
+	segment = filepath.Join(path, segment)
+	bz, err := os.ReadFile(segment)
+	if err != nil {
+		return nil, err
+	}
+	size := 0
+	for size < len(bz) {
+		length, n := binary.Uvarint(bz[size:])
+		if n <= 0 || uint64(len(bz)-size-n) < length {
+			break
+		}
+		size += n + int(length)
+	}
+	if size == len(bz) {
+		// the log is corrupt otherwise than by a torn entry.
+		return nil, wal.ErrCorrupt
+	}
+	if err := os.Truncate(segment, int64(size)); err != nil {
+		return nil, err
+	}
+	return &TornSegment{Path: segment, Size: int64(size)}, nil
 }
 
 type walCache struct {
@@ -63,46 +142,83 @@ type walCache struct {
 }
 
 type checkpointArgs struct {
-	index   uint64
-	version int64
+	from, index uint64
+	version     int64
+	cache       *walCache
 }
 
-type Wal struct {
-	wal                *wal.Log
-	commitment         dbm.DB
-	checkpointInterval int
-	checkpointHead     uint64
-	checkpointCh       chan *checkpointArgs
-	CheckpointSignal   chan struct{}
+func newWalCache(sinceVersion int64) *walCache {
+	return &walCache{
+		puts:         make(map[nodeCacheKey]*deferredNode),
+		deletes:      []*deferredNode{},
+		sinceVersion: sinceVersion,
+	}
+}
+
+// checkpointQueueSize is how many checkpoints may wait for CheckpointRunner before MaybeCheckpoint
+// blocks.
+const checkpointQueueSize = 2
+
+// defaultCheckpointSize is how many bytes are written to the log between checkpoints, by default ten
+// entries of changesets buffered up to the default flush size.
+const defaultCheckpointSize = 10 * defaultWalFlushSize
 
+type Wal struct {
+	wal            *wal.Log
+	commitment     dbm.DB
+	checkpointSize int64
+	checkpointHead uint64
+	// checkpointBytes is the size of the entries written since the last checkpoint.
+	checkpointBytes  int64
+	checkpointCh     chan *checkpointArgs
+	CheckpointSignal chan struct{}
+
+	// cacheLock guards hotCache, hotArgs, pending, runnerDone and checkpointErr.
 	cacheLock sync.RWMutex
 	hotCache  *walCache
-	coldCache *walCache
-
-	MetricNodesRead CountMetric
-	MetricWalSize   GaugeMetric
-	MetricCacheMiss CountMetric
-	MetricCacheHit  CountMetric
-	MetricCacheSize GaugeMetric
+	// hotArgs checkpoints hotCache up to the last entry passed to MaybeCheckpoint, nil if none was since
+	// the last checkpoint.
+	hotArgs *checkpointArgs
+	// pending holds the caches queued for CheckpointRunner, oldest first. They are read until they are
+	// flushed to commitment.
+	pending []*walCache
+	// runnerDone is closed when CheckpointRunner returns, and nil while it is not running.
+	runnerDone    chan struct{}
+	checkpointErr error
+	// tornRecord is why Recover truncated the last entry of the log, if it did.
+	tornRecord error
+
+	durability Durability
+	// syncLock guards unsynced, the number of writes since the last sync, and syncErr.
+	syncLock sync.Mutex
+	unsynced int
+	syncErr  error
+	syncStop chan struct{}
+	syncDone chan struct{}
+
+	// codec compresses the changesets of records, rawBytes and storedBytes total their sizes before and
+	// after.
+	codec       Codec
+	rawBytes    int64
+	storedBytes int64
+
+	MetricSyncDuration     HistogramMetric
+	MetricCompressionRatio GaugeMetric
+	MetricNodesRead        CountMetric
+	MetricWalSize          GaugeMetric
+	MetricCacheMiss        CountMetric
+	MetricCacheHit         CountMetric
+	MetricCacheSize        GaugeMetric
 }
 
 func NewWal(wal *wal.Log, commitment dbm.DB) *Wal {
-	hot := &walCache{
-		puts:    make(map[nodeCacheKey]*deferredNode),
-		deletes: []*deferredNode{},
-	}
-	cold := &walCache{
-		puts:    make(map[nodeCacheKey]*deferredNode),
-		deletes: []*deferredNode{},
-	}
 	return &Wal{
-		wal:                wal,
-		commitment:         commitment,
-		hotCache:           hot,
-		coldCache:          cold,
-		checkpointCh:       make(chan *checkpointArgs, 10),
-		checkpointInterval: 10,
-		CheckpointSignal:   make(chan struct{}, 2),
+		wal:              wal,
+		commitment:       commitment,
+		hotCache:         newWalCache(0),
+		checkpointCh:     make(chan *checkpointArgs, checkpointQueueSize),
+		checkpointSize:   defaultCheckpointSize,
+		CheckpointSignal: make(chan struct{}, 2),
 	}
 }
 
@@ -110,13 +226,20 @@ func (r *Wal) Write(idx uint64, bz []byte) error {
 	if r.MetricWalSize != nil {
 		r.MetricWalSize.Add(float64(len(bz)))
 	}
-	return r.wal.Write(idx, bz)
+	if err := r.syncError(); err != nil {
+		return err
+	}
+	if err := r.wal.Write(idx, bz); err != nil {
+		return err
+	}
+	r.checkpointBytes += int64(len(bz))
+	return r.afterWrite()
 }
 
 func (r *Wal) CacheGet(key nodeCacheKey) (*Node, error) {
 	r.cacheLock.RLock()
-	hot := *r.hotCache
-	cold := *r.coldCache
+	hot := r.hotCache
+	pending := r.pending
 	r.cacheLock.RUnlock()
 
 	if dn, ok := hot.puts[key]; ok {
@@ -126,11 +249,14 @@ func (r *Wal) CacheGet(key nodeCacheKey) (*Node, error) {
 		return dn.node, nil
 	}
 
-	if dn, ok := cold.puts[key]; ok {
-		if r.MetricCacheHit != nil {
-			r.MetricCacheHit.Inc()
+	// queued caches are only read while a checkpoint flushes them, newest first.
+	for i := len(pending) - 1; i >= 0; i-- {
+		if dn, ok := pending[i].puts[key]; ok {
+			if r.MetricCacheHit != nil {
+				r.MetricCacheHit.Inc()
+			}
+			return dn.node, nil
 		}
-		return dn.node, nil
 	}
 
 	if r.MetricCacheMiss != nil {
@@ -166,6 +292,125 @@ func (r *Wal) FirstIndex() (uint64, error) {
 	return r.wal.FirstIndex()
 }
 
+func (r *Wal) LastIndex() (uint64, error) {
+	return r.wal.LastIndex()
+}
+
+// Recover replays the records of the log from FirstIndex to LastIndex into the hot cache, so that the
+// next checkpoint writes the changes logged since the last one to commitment. A record torn by a crash
+// can only be in the last entry; replay stops there and the entry is truncated to the records before
+// it, as reported by TornRecord. Any other invalid record, including one of a format this release can't read, fails recovery and
+// leaves the log untouched. It returns the version of the last record recovered, or 0 if the log is
+// empty.
+func (r *Wal) Recover() (int64, error) {
+	first, err := r.wal.FirstIndex()
+	if err != nil {
+		return 0, err
+	}
+	last, err := r.wal.LastIndex()
+	if err != nil {
+		return 0, err
+	}
+	if first == 0 {
+		return 0, nil
+	}
+
+	r.cacheLock.Lock()
+	hot := r.hotCache
+	r.cacheLock.Unlock()
+	// the first entry may have been checkpointed already, so deletes of nodes of any version are kept.
+	hot.sinceVersion = math.MaxInt64
+
+	var version int64
+	for idx := first; idx <= last; idx++ {
+		bz, err := r.wal.Read(idx)
+		if err != nil {
+			return 0, err
+		}
+		records, n, recordErr := readWalRecords(bz)
+		if recordErr != nil && (idx != last || !errors.Is(recordErr, errTornRecord)) {
+			return 0, fmt.Errorf("wal: entry %d, %w", idx, recordErr)
+		}
+		for _, record := range records {
+			if err := r.replayRecord(record); err != nil {
+				return 0, fmt.Errorf("wal: entry %d, version %d, %w", idx, record.version, err)
+			}
+			version = record.version
+		}
+		r.checkpointBytes += int64(n)
+		if recordErr != nil {
+			r.tornRecord = fmt.Errorf("wal: entry %d, %w", idx, recordErr)
+			if err := r.truncateEntry(idx, bz[:n]); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	hot.sinceVersion = version + 1
+	r.checkpointHead, err = r.wal.FirstIndex()
+	if err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// TornRecord returns why Recover truncated the last entry of the log to its good records, or nil if the
+// log ended with a complete record.
+func (r *Wal) TornRecord() error {
+	return r.tornRecord
+}
+
+func (r *Wal) replayRecord(record walRecord) error {
+	bz, err := record.codec.decode(record.changeset)
+	if err != nil {
+		return err
+	}
+	changeset := &ChangeSet{}
+	if err := proto.Unmarshal(bz, changeset); err != nil {
+		return err
+	}
+	for _, pair := range changeset.Pairs {
+		var nk nodeCacheKey
+		if len(pair.Key) != len(nk) {
+			return fmt.Errorf("invalid node key %X", pair.Key)
+		}
+		copy(nk[:], pair.Key)
+		if pair.Delete {
+			r.CachePut(&deferredNode{nodeKey: nk, deleted: true})
+			continue
+		}
+		node, err := MakeNode(pair.Key, pair.Value)
+		if err != nil {
+			return err
+		}
+		r.CachePut(&deferredNode{nodeKey: nk, node: node})
+	}
+	return nil
+}
+
+// truncateEntry drops the entries after idx and replaces entry idx by its valid prefix. The log can't
+// be truncated to nothing, so if idx is the first entry the prefix is written after it and idx dropped
+// from the front instead.
+func (r *Wal) truncateEntry(idx uint64, prefix []byte) error {
+	first, err := r.wal.FirstIndex()
+	if err != nil {
+		return err
+	}
+	if idx > first {
+		if err := r.wal.TruncateBack(idx - 1); err != nil {
+			return err
+		}
+		return r.wal.Write(idx, prefix)
+	}
+	if err := r.wal.TruncateBack(idx); err != nil {
+		return err
+	}
+	if err := r.wal.Write(idx+1, prefix); err != nil {
+		return err
+	}
+	return r.wal.TruncateFront(idx + 1)
+}
+
 type deferredNode struct {
 	nodeBz  *[]byte
 	node    *Node
@@ -173,45 +418,148 @@ type deferredNode struct {
 	deleted bool
 }
 
-func (r *Wal) CheckpointRunner(ctx context.Context) error {
+// CheckpointRunner flushes the checkpoints queued by MaybeCheckpoint to commitment in the background,
+// until ctx is done or a checkpoint fails. When ctx is done it flushes the checkpoints still queued, and
+// then the hot cache up to the last entry passed to MaybeCheckpoint, before returning. While it runs MaybeCheckpoint only queues checkpoints, blocking while the queue is
+// full, and returns the error of a failed one.
+func (r *Wal) CheckpointRunner(ctx context.Context) (err error) {
+	done := make(chan struct{})
+	r.cacheLock.Lock()
+	if r.runnerDone != nil {
+		r.cacheLock.Unlock()
+		return errors.New("wal: checkpoint runner is already running")
+	}
+	r.runnerDone = done
+	r.cacheLock.Unlock()
+
+	defer func() {
+		r.cacheLock.Lock()
+		if err != nil && err != ctx.Err() {
+			r.checkpointErr = err
+		}
+		r.runnerDone = nil
+		r.cacheLock.Unlock()
+		close(done)
+	}()
+
 	for {
 		select {
 		case <-ctx.Done():
-			return ctx.Err()
+			for {
+				select {
+				case args := <-r.checkpointCh:
+					if err := r.runCheckpoint(args); err != nil {
+						return err
+					}
+				default:
+					if err := r.checkpointHot(); err != nil {
+						return err
+					}
+					return ctx.Err()
+				}
+			}
 		case args := <-r.checkpointCh:
-			if r.checkpointHead == 0 {
-				r.checkpointHead = args.index
+			if err := r.runCheckpoint(args); err != nil {
+				return err
 			}
+		}
+	}
+}
 
-			if args.index-r.checkpointHead >= uint64(r.checkpointInterval) {
-				r.cacheLock.Lock()
-				r.hotCache, r.coldCache = r.coldCache, r.hotCache
-				r.hotCache.sinceVersion = args.version + 1
-				r.cacheLock.Unlock()
-				err := r.Checkpoint(args.index, args.version, true)
-				if err != nil {
-					return err
-				}
-			}
+// checkpointHot queues the hot cache and flushes it, so that no write is left out of commitment when
+// CheckpointRunner stops.
+func (r *Wal) checkpointHot() error {
+	r.cacheLock.Lock()
+	args := r.hotArgs
+	if args != nil {
+		r.pending = append(r.pending, args.cache)
+		r.hotCache = newWalCache(args.version + 1)
+		r.hotArgs = nil
+	}
+	r.cacheLock.Unlock()
+	if args == nil {
+		return nil
+	}
+	if r.MetricCacheSize != nil {
+		r.MetricCacheSize.Set(0)
+	}
+	return r.runCheckpoint(args)
+}
+
+// runCheckpoint flushes a queued cache, which stays readable until it is in commitment.
+func (r *Wal) runCheckpoint(args *checkpointArgs) error {
+	r.cacheLock.RLock()
+	queued := false
+	for _, cache := range r.pending {
+		queued = queued || cache == args.cache
+	}
+	r.cacheLock.RUnlock()
+	// a synchronous checkpoint flushed it already.
+	if !queued {
+		return nil
+	}
+
+	if err := r.flushCache(args.cache, args.from, args.index); err != nil {
+		return err
+	}
+	if err := r.truncateFront(args.index); err != nil {
+		return err
+	}
+
+	r.cacheLock.Lock()
+	var pending []*walCache
+	for _, cache := range r.pending {
+		if cache != args.cache {
+			pending = append(pending, cache)
 		}
 	}
+	r.pending = pending
+	r.cacheLock.Unlock()
+
+	r.signalCheckpoint()
+	return nil
 }
 
-func (r *Wal) Checkpoint(index uint64, version int64, async bool) error {
-	var wcache *walCache
-	if async {
-		wcache = r.coldCache
-	} else {
-		wcache = r.hotCache
+// Checkpoint synchronously flushes the queued caches and then the hot cache to commitment, and truncates
+// the log before index.
+func (r *Wal) Checkpoint(index uint64, version int64) error {
+	r.cacheLock.RLock()
+	caches := append(append([]*walCache{}, r.pending...), r.hotCache)
+	r.cacheLock.RUnlock()
+
+	for _, cache := range caches {
+		if err := r.flushCache(cache, r.checkpointHead, index); err != nil {
+			return err
+		}
+	}
+	if err := r.truncateFront(index); err != nil {
+		return err
 	}
 
+	r.cacheLock.Lock()
+	r.pending = nil
+	r.hotCache = newWalCache(version + 1)
+	r.hotArgs = nil
+	r.cacheLock.Unlock()
+	if r.MetricCacheSize != nil {
+		r.MetricCacheSize.Set(0)
+	}
+	r.checkpointHead = index
+	r.checkpointBytes = 0
+
+	r.signalCheckpoint()
+	return nil
+}
+
+// flushCache writes the puts and deletes of cache, the changes logged in [from, index), to commitment.
+func (r *Wal) flushCache(cache *walCache, from, index uint64) error {
 	start := time.Now()
 	setCount := 0
 	deleteCount := 0
 	fmt.Printf("wal: checkpointing now. [%d - %d) will be flushed to state commitment\n",
-		r.checkpointHead, index)
+		from, index)
 	buf := new(bytes.Buffer)
-	for k, dn := range wcache.puts {
+	for k, dn := range cache.puts {
 		err := dn.node.writeBytes(buf)
 		if err != nil {
 			return err
@@ -224,58 +572,86 @@ func (r *Wal) Checkpoint(index uint64, version int64, async bool) error {
 		buf.Reset()
 		setCount++
 	}
-	for _, dn := range wcache.deletes {
+	for _, dn := range cache.deletes {
 		err := r.commitment.Delete(dn.nodeKey[:])
 		if err != nil {
 			return err
 		}
 		deleteCount++
 	}
-	if err := r.wal.TruncateFront(index); err != nil {
-		return err
-	}
 
-	if async {
-		r.cacheLock.Lock()
-		r.coldCache = &walCache{
-			puts:    make(map[nodeCacheKey]*deferredNode),
-			deletes: []*deferredNode{},
-		}
-		r.cacheLock.Unlock()
-	} else {
-		r.hotCache = &walCache{
-			puts:         make(map[nodeCacheKey]*deferredNode),
-			deletes:      []*deferredNode{},
-			sinceVersion: version + 1,
-		}
-	}
+	fmt.Printf("wal: checkpoint completed in %.3fs; %d sets, %d deletes\n",
+		time.Since(start).Seconds(), setCount, deleteCount)
+	return nil
+}
 
-	//if r.MetricWalSize != nil {
-	//	r.MetricWalSize.Sub(checkpointBz)
-	//}
-	if r.MetricCacheSize != nil {
-		r.MetricCacheSize.Set(0)
+// truncateFront drops the entries of the log before index, unless they are gone already.
+func (r *Wal) truncateFront(index uint64) error {
+	first, err := r.wal.FirstIndex()
+	if err != nil {
+		return err
 	}
-	r.checkpointHead = index
-	//checkpointBz = 0
-
-	if r.CheckpointSignal != nil {
-		r.CheckpointSignal <- struct{}{}
+	if index <= first {
+		return nil
 	}
+	return r.wal.TruncateFront(index)
+}
 
-	fmt.Printf("wal: checkpoint completed in %.3fs; %d sets, %d deletes\n",
-		time.Since(start).Seconds(), setCount, deleteCount)
-	return nil
+// signalCheckpoint notifies CheckpointSignal of a completed checkpoint, unless nobody is listening.
+func (r *Wal) signalCheckpoint() {
+	select {
+	case r.CheckpointSignal <- struct{}{}:
+	default:
+	}
 }
 
+// MaybeCheckpoint checkpoints the hot cache once checkpointSize bytes have been written to the log since
+// the last checkpoint, however many entries they took. While CheckpointRunner runs, the hot cache is queued for it and replaced by an empty
+// one, blocking while the queue is full. It returns the error of a failed background checkpoint.
 func (r *Wal) MaybeCheckpoint(index uint64, version int64) error {
+	if err := r.CheckpointErr(); err != nil {
+		return err
+	}
 	if r.checkpointHead == 0 {
 		r.checkpointHead = index
 	}
 
-	if index-r.checkpointHead >= uint64(r.checkpointInterval) {
-		return r.Checkpoint(index, version, false)
+	r.cacheLock.Lock()
+	args := &checkpointArgs{from: r.checkpointHead, index: index, version: version, cache: r.hotCache}
+	r.hotArgs = args
+	if r.checkpointBytes < r.checkpointSize {
+		r.cacheLock.Unlock()
+		return nil
 	}
+	done := r.runnerDone
+	if done == nil {
+		r.cacheLock.Unlock()
+		return r.Checkpoint(index, version)
+	}
+	r.pending = append(r.pending, r.hotCache)
+	r.hotCache = newWalCache(version + 1)
+	r.hotArgs = nil
+	r.cacheLock.Unlock()
+	if r.MetricCacheSize != nil {
+		r.MetricCacheSize.Set(0)
+	}
+	r.checkpointHead = index
+	r.checkpointBytes = 0
+
+	select {
+	case r.checkpointCh <- args:
+		return nil
+	case <-done:
+		// the cache stays queued until the next synchronous checkpoint.
+		return r.CheckpointErr()
+	}
+}
 
-	return nil
+// CheckpointErr returns, once, the error a background checkpoint failed with.
+func (r *Wal) CheckpointErr() error {
+	r.cacheLock.Lock()
+	defer r.cacheLock.Unlock()
+	err := r.checkpointErr
+	r.checkpointErr = nil
+	return err
 }
@@ -0,0 +1,106 @@
+package v3
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// An entry of the log is a sequence of records, one per committed version:
+//
+//	magic | format version | block version | length | crc32c | changeset
+//
+// The checksum covers the header fields before it and the stored changeset, so a record torn by a crash
+// or otherwise corrupted is detected on replay. An uncompressed changeset is stored as is, and one
+// compressed by a codec as
+//
+//	0x00 | codec | compressed changeset
+//
+// No ChangeSet encodes to a leading zero byte, which is an invalid protobuf tag, so releases which
+// predate compression fail to replay a compressed changeset instead of mistaking it for a torn record.
+const (
+	walRecordMagic         = "IAVW"
+	walRecordFormatVersion = 1
+	walRecordHeaderSize    = 4 + 1 + 8 + 4 + 4
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// errTornRecord is wrapped by the errors of records which are cut short or fail their checksum, as a
+// crash while writing leaves them. A record with a bad magic or an unknown format version is instead
+// corrupt or written by a newer release, and must not be truncated away.
+var errTornRecord = errors.New("torn record")
+
+type walRecord struct {
+	version int64
+	codec   Codec
+	// changeset is as stored, encoded by codec.
+	changeset []byte
+}
+
+// appendWalRecord frames the changeset of version, already encoded by codec, as a record at the end of
+// buf.
+func appendWalRecord(buf *bytes.Buffer, version int64, codec Codec, changeset []byte) {
+	var envelope []byte
+	if codec != CodecNone {
+		envelope = []byte{0, byte(codec)}
+	}
+	var header [walRecordHeaderSize]byte
+	copy(header[:], walRecordMagic)
+	header[4] = walRecordFormatVersion
+	binary.BigEndian.PutUint64(header[5:], uint64(version))
+	binary.BigEndian.PutUint32(header[13:], uint32(len(envelope)+len(changeset)))
+	crc := crc32.Update(crc32.Checksum(header[:17], crc32c), crc32c, envelope)
+	crc = crc32.Update(crc, crc32c, changeset)
+	binary.BigEndian.PutUint32(header[17:], crc)
+	buf.Write(header[:])
+	buf.Write(envelope)
+	buf.Write(changeset)
+}
+
+// readWalRecords splits an entry into its records. If a record is invalid it returns the records before
+// it, the length of the entry they take up, and an error describing the invalid record, which wraps
+// errTornRecord if the record may have been torn.
+func readWalRecords(entry []byte) ([]walRecord, int, error) {
+	var records []walRecord
+	offset := 0
+	for offset < len(entry) {
+		bz := entry[offset:]
+		if len(bz) < 5 {
+			return records, offset, fmt.Errorf("%w: short header at offset %d", errTornRecord, offset)
+		}
+		if string(bz[:4]) != walRecordMagic {
+			return records, offset, fmt.Errorf("bad record magic at offset %d", offset)
+		}
+
+		if bz[4] != walRecordFormatVersion {
+			return records, offset, fmt.Errorf("unsupported record format version %d at offset %d", bz[4], offset)
+		}
+		if len(bz) < walRecordHeaderSize {
+			return records, offset, fmt.Errorf("%w: short header at offset %d", errTornRecord, offset)
+		}
+		record := walRecord{codec: CodecNone}
+		record.version = int64(binary.BigEndian.Uint64(bz[5:]))
+		length := int(binary.BigEndian.Uint32(bz[13:]))
+		if len(bz)-walRecordHeaderSize < length {
+			return records, offset, fmt.Errorf("%w: short changeset at offset %d", errTornRecord, offset)
+		}
+		record.changeset = bz[walRecordHeaderSize : walRecordHeaderSize+length]
+		crc := crc32.Update(crc32.Checksum(bz[:17], crc32c), crc32c, record.changeset)
+		if crc != binary.BigEndian.Uint32(bz[17:]) {
+			return records, offset, fmt.Errorf("%w: checksum mismatch at offset %d", errTornRecord, offset)
+		}
+		if length > 0 && record.changeset[0] == 0 {
+			if length < 2 {
+				return records, offset, fmt.Errorf("invalid codec envelope at offset %d", offset)
+			}
+			record.codec = Codec(record.changeset[1])
+			record.changeset = record.changeset[2:]
+		}
+		records = append(records, record)
+		offset += walRecordHeaderSize + length
+	}
+	return records, offset, nil
+}
@@ -1,41 +1,483 @@
 package v6
 
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	dbm "github.com/cosmos/cosmos-db"
+	"github.com/kocubinski/iavlite/core"
+	encoding "github.com/kocubinski/iavlite/internal"
+)
+
+// nodeDB is the backing store for nodes flushed from and faulted into the node pool.
+// Get returns nil if no node is stored at nk; the returned node's nodeKey is nk.
+//
+// A nodeDB is used by the tree's goroutine while a checkpoint batch is committed on another, so reads and
+// direct writes must be safe to run concurrently with nodeBatch.Commit.
+type nodeDB interface {
+	Set(node *Node) error
+	Get(nk *nodeKey) (*Node, error)
+
+	// NewBatch starts a batch counting its writes in metrics.
+	NewBatch(metrics *core.TreeMetrics) nodeBatch
+	// Meta returns the metadata of the last committed batch, or nil if there is none.
+	Meta() (*treeMeta, error)
+	Roots() (map[int64]*nodeKey, error)
+	Orphans() ([]orphan, error)
+	// DeleteNodesAfter deletes the nodes of versions after version, which were written back ahead of a
+	// checkpoint that was never committed.
+	DeleteNodesAfter(version int64) error
+}
+
+// nodeBatch collects the writes of a checkpoint which are committed atomically along with the tree
+// metadata. Writes are not visible to Get until committed. A batch may be committed on a different
+// goroutine than the one which built it, but is not safe for concurrent use.
+type nodeBatch interface {
+	Set(node *Node) error
+	Delete(nk *nodeKey) error
+	// SetRoot records the root of a retained version, nk is nil for an empty tree.
+	SetRoot(version int64, nk *nodeKey) error
+	DeleteRoot(version int64) error
+	// SetOrphan records an orphan kept in the db for retained versions.
+	SetOrphan(o orphan) error
+	DeleteOrphan(o orphan) error
+
+	// Commit writes the batch along with meta. meta is nil for a writeback, which leaves the last
+	// checkpoint in place.
+	Commit(meta *treeMeta) error
+}
+
+// treeMeta is the record written with each checkpoint from which a tree is reopened.
+type treeMeta struct {
+	version int64
+	// rootKey is nil for an empty tree.
+	rootKey *nodeKey
+}
+
+// metaKey is the store key of treeMeta. It is shorter than a node key so the two never collide.
+var metaKey = []byte("meta")
+
+const (
+	rootPrefix   = 'r'
+	orphanPrefix = 'o'
+	// root and orphan record keys are a prefix byte followed by a version, and for orphans a node key.
+	// their lengths differ from node keys and metaKey so that none collide.
+	rootKeySize   = 9
+	orphanKeySize = 9 + nodeKeySize
+)
+
+func rootRecordKey(version int64) []byte {
+	key := make([]byte, rootKeySize)
+	key[0] = rootPrefix
+	binary.BigEndian.PutUint64(key[1:], uint64(version))
+	return key
+}
+
+func orphanRecordKey(o orphan) []byte {
+	key := make([]byte, orphanKeySize)
+	key[0] = orphanPrefix
+	binary.BigEndian.PutUint64(key[1:], uint64(o.orphanedAt))
+	copy(key[9:], o.nodeKey[:])
+	return key
+}
+
+func (m *treeMeta) bytes() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := encoding.EncodeVarint(buf, m.version); err != nil {
+		return nil, fmt.Errorf("writing version, %w", err)
+	}
+	var rootKey []byte
+	if m.rootKey != nil {
+		rootKey = m.rootKey[:]
+	}
+	if err := encoding.EncodeBytes(buf, rootKey); err != nil {
+		return nil, fmt.Errorf("writing root key, %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeTreeMeta(buf []byte) (*treeMeta, error) {
+	version, n, err := encoding.DecodeVarint(buf)
+	if err != nil {
+		return nil, fmt.Errorf("decoding version, %w", err)
+	}
+	rootKey, _, err := encoding.DecodeBytes(buf[n:])
+	if err != nil {
+		return nil, fmt.Errorf("decoding root key, %w", err)
+	}
+	m := &treeMeta{version: version}
+	switch len(rootKey) {
+	case 0:
+	case nodeKeySize:
+		m.rootKey = new(nodeKey)
+		copy(m.rootKey[:], rootKey)
+	default:
+		return nil, errors.New("invalid root key length")
+	}
+	return m, nil
+}
+
+var (
+	_ nodeDB    = (*memDB)(nil)
+	_ nodeDB    = (*kvDB)(nil)
+	_ nodeBatch = (*memBatch)(nil)
+	_ nodeBatch = (*kvBatch)(nil)
+)
+
 // memDB approximates a database with a map.
 // it used to store nodes in memory so that pool size can be constrained and tested.
 type memDB struct {
-	nodes          map[nodeKey]Node
-	setCount       int
-	deleteCount    int
-	lastCheckpoint int64
+	mtx     sync.RWMutex
+	nodes   map[nodeKey]Node
+	meta    *treeMeta
+	roots   map[int64]*nodeKey
+	orphans map[orphan]bool
+	metrics *core.TreeMetrics
 }
 
-func newMemDB() *memDB {
+func newMemDB(metrics *core.TreeMetrics) *memDB {
 	return &memDB{
-		nodes: make(map[nodeKey]Node),
+		nodes:   make(map[nodeKey]Node),
+		roots:   make(map[int64]*nodeKey),
+		orphans: make(map[orphan]bool),
+		metrics: metrics,
 	}
 }
 
-func (db *memDB) Set(node *Node) {
-	nk := *node.nodeKey
+// storedNode returns the copy of node which is kept in the map.
+func storedNode(node *Node) Node {
 	n := *node
 	n.overflow = false
 	n.dirty = false
+	n.lock = false
 	n.leftNode = nil
 	n.rightNode = nil
 	n.frameId = -1
-	db.nodes[nk] = n
-	db.setCount++
+	return n
+}
+
+func (db *memDB) Set(node *Node) error {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	db.nodes[*node.nodeKey] = storedNode(node)
+	db.metrics.DbSet++
+	return nil
 }
 
-func (db *memDB) Get(nk nodeKey) *Node {
-	n, ok := db.nodes[nk]
+func (db *memDB) Get(nk *nodeKey) (*Node, error) {
+	db.mtx.RLock()
+	defer db.mtx.RUnlock()
+	db.metrics.DbGet++
+	n, ok := db.nodes[*nk]
 	if !ok {
+		return nil, nil
+	}
+	n.nodeKey = nk
+	return &n, nil
+}
+
+func (db *memDB) NewBatch(metrics *core.TreeMetrics) nodeBatch {
+	return &memBatch{db: db, metrics: metrics}
+}
+
+func (db *memDB) Meta() (*treeMeta, error) {
+	db.mtx.RLock()
+	defer db.mtx.RUnlock()
+	return db.meta, nil
+}
+
+func (db *memDB) Roots() (map[int64]*nodeKey, error) {
+	db.mtx.RLock()
+	defer db.mtx.RUnlock()
+	roots := make(map[int64]*nodeKey, len(db.roots))
+	for v, nk := range db.roots {
+		roots[v] = nk
+	}
+	return roots, nil
+}
+
+func (db *memDB) Orphans() ([]orphan, error) {
+	db.mtx.RLock()
+	defer db.mtx.RUnlock()
+	orphans := make([]orphan, 0, len(db.orphans))
+	for o := range db.orphans {
+		orphans = append(orphans, o)
+	}
+	return orphans, nil
+}
+
+func (db *memDB) DeleteNodesAfter(version int64) error {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	for nk := range db.nodes {
+		if nk.Version() > version {
+			delete(db.nodes, nk)
+			db.metrics.DbDelete++
+		}
+	}
+	return nil
+}
+
+// memBatch queues changes to a memDB and applies them under its lock on Commit.
+type memBatch struct {
+	db      *memDB
+	ops     []func(db *memDB)
+	metrics *core.TreeMetrics
+}
+
+func (b *memBatch) Set(node *Node) error {
+	n := storedNode(node)
+	b.ops = append(b.ops, func(db *memDB) { db.nodes[*n.nodeKey] = n })
+	b.metrics.DbSet++
+	return nil
+}
+
+func (b *memBatch) Delete(nk *nodeKey) error {
+	key := *nk
+	b.ops = append(b.ops, func(db *memDB) { delete(db.nodes, key) })
+	b.metrics.DbDelete++
+	return nil
+}
+
+func (b *memBatch) SetRoot(version int64, nk *nodeKey) error {
+	b.ops = append(b.ops, func(db *memDB) { db.roots[version] = nk })
+	return nil
+}
+
+func (b *memBatch) DeleteRoot(version int64) error {
+	b.ops = append(b.ops, func(db *memDB) { delete(db.roots, version) })
+	return nil
+}
+
+func (b *memBatch) SetOrphan(o orphan) error {
+	b.ops = append(b.ops, func(db *memDB) { db.orphans[o] = true })
+	return nil
+}
+
+func (b *memBatch) DeleteOrphan(o orphan) error {
+	b.ops = append(b.ops, func(db *memDB) { delete(db.orphans, o) })
+	return nil
+}
+
+func (b *memBatch) Commit(meta *treeMeta) error {
+	b.db.mtx.Lock()
+	defer b.db.mtx.Unlock()
+	for _, op := range b.ops {
+		op(b.db)
+	}
+	if meta != nil {
+		m := *meta
+		b.db.meta = &m
+	}
+	b.ops = nil
+	return nil
+}
+
+// kvDB stores nodes in a cosmos-db backend (goleveldb, pebble, ...) in their serialized form so that
+// the I/O cost of pool faults and flushes is real.
+type kvDB struct {
+	db      dbm.DB
+	buf     *bytes.Buffer
+	metrics *core.TreeMetrics
+}
+
+func newKVDB(db dbm.DB, metrics *core.TreeMetrics) *kvDB {
+	return &kvDB{
+		db:      db,
+		buf:     new(bytes.Buffer),
+		metrics: metrics,
+	}
+}
+
+func (kv *kvDB) Set(node *Node) error {
+	kv.buf.Reset()
+	if err := node.writeBytes(kv.buf); err != nil {
+		return err
+	}
+	if err := kv.db.Set(node.nodeKey[:], kv.buf.Bytes()); err != nil {
+		return err
+	}
+	kv.metrics.DbSet++
+	kv.metrics.DbWriteBytes += int64(kv.buf.Len())
+	return nil
+}
+
+func (kv *kvDB) Get(nk *nodeKey) (*Node, error) {
+	kv.metrics.DbGet++
+	bz, err := kv.db.Get(nk[:])
+	if err != nil {
+		return nil, err
+	}
+	if bz == nil {
+		return nil, nil
+	}
+	kv.metrics.DbReadBytes += int64(len(bz))
+	node, err := MakeNode(nk, bz)
+	if err != nil {
+		return nil, fmt.Errorf("kvDB/Get/MakeNode; nodeKey: %s; %w", nk, err)
+	}
+	return node, nil
+}
+
+func (kv *kvDB) NewBatch(metrics *core.TreeMetrics) nodeBatch {
+	return &kvBatch{
+		batch:   kv.db.NewBatch(),
+		buf:     new(bytes.Buffer),
+		metrics: metrics,
+	}
+}
+
+func (kv *kvDB) Meta() (*treeMeta, error) {
+	bz, err := kv.db.Get(metaKey)
+	if err != nil {
+		return nil, err
+	}
+	if bz == nil {
+		return nil, nil
+	}
+	meta, err := decodeTreeMeta(bz)
+	if err != nil {
+		return nil, fmt.Errorf("kvDB/Meta; %w", err)
+	}
+	return meta, nil
+}
+
+func (kv *kvDB) Roots() (map[int64]*nodeKey, error) {
+	roots := make(map[int64]*nodeKey)
+	err := kv.scan(rootPrefix, rootKeySize, func(key, value []byte) error {
+		version := int64(binary.BigEndian.Uint64(key[1:]))
+		switch len(value) {
+		case 0:
+			roots[version] = nil
+		case nodeKeySize:
+			nk := new(nodeKey)
+			copy(nk[:], value)
+			roots[version] = nk
+		default:
+			return fmt.Errorf("invalid root key length for version %d", version)
+		}
 		return nil
+	})
+	return roots, err
+}
+
+func (kv *kvDB) Orphans() ([]orphan, error) {
+	var orphans []orphan
+	err := kv.scan(orphanPrefix, orphanKeySize, func(key, _ []byte) error {
+		o := orphan{orphanedAt: int64(binary.BigEndian.Uint64(key[1:]))}
+		copy(o.nodeKey[:], key[9:])
+		orphans = append(orphans, o)
+		return nil
+	})
+	return orphans, err
+}
+
+func (kv *kvDB) DeleteNodesAfter(version int64) error {
+	// node keys lead with their version, so the nodes after version sort after the first key of the next.
+	itr, err := kv.db.Iterator(newNodeKey(version+1, 0)[:], nil)
+	if err != nil {
+		return err
+	}
+	defer itr.Close()
+	batch := kv.db.NewBatch()
+	defer batch.Close()
+	for ; itr.Valid(); itr.Next() {
+		// the meta, root and orphan records sort after the node keys but differ in length.
+		if len(itr.Key()) != nodeKeySize {
+			continue
+		}
+		if err := batch.Delete(bytes.Clone(itr.Key())); err != nil {
+			return err
+		}
+		kv.metrics.DbDelete++
+	}
+	if err := itr.Error(); err != nil {
+		return err
+	}
+	return batch.WriteSync()
+}
+
+// scan calls fn with every record under prefix. Keys of other lengths are node keys which happen to
+// share the prefix byte and are skipped.
+func (kv *kvDB) scan(prefix byte, keySize int, fn func(key, value []byte) error) error {
+	itr, err := kv.db.Iterator([]byte{prefix}, []byte{prefix + 1})
+	if err != nil {
+		return err
+	}
+	defer itr.Close()
+	for ; itr.Valid(); itr.Next() {
+		if len(itr.Key()) != keySize {
+			continue
+		}
+		if err := fn(itr.Key(), itr.Value()); err != nil {
+			return err
+		}
+	}
+	return itr.Error()
+}
+
+// kvBatch wraps a cosmos-db batch, which is committed with a synced write.
+type kvBatch struct {
+	batch   dbm.Batch
+	buf     *bytes.Buffer
+	metrics *core.TreeMetrics
+}
+
+func (b *kvBatch) Set(node *Node) error {
+	b.buf.Reset()
+	if err := node.writeBytes(b.buf); err != nil {
+		return err
 	}
-	return &n
+	// the batch may hold on to the value until written.
+	if err := b.batch.Set(node.nodeKey[:], bytes.Clone(b.buf.Bytes())); err != nil {
+		return err
+	}
+	b.metrics.DbSet++
+	b.metrics.DbWriteBytes += int64(b.buf.Len())
+	return nil
+}
+
+func (b *kvBatch) Delete(nk *nodeKey) error {
+	if err := b.batch.Delete(nk[:]); err != nil {
+		return err
+	}
+	b.metrics.DbDelete++
+	return nil
+}
+
+func (b *kvBatch) SetRoot(version int64, nk *nodeKey) error {
+	value := []byte{}
+	if nk != nil {
+		value = nk[:]
+	}
+	return b.batch.Set(rootRecordKey(version), value)
 }
 
-func (db *memDB) Delete(nk nodeKey) {
-	delete(db.nodes, nk)
-	db.deleteCount++
+func (b *kvBatch) DeleteRoot(version int64) error {
+	return b.batch.Delete(rootRecordKey(version))
+}
+
+func (b *kvBatch) SetOrphan(o orphan) error {
+	return b.batch.Set(orphanRecordKey(o), []byte{})
+}
+
+func (b *kvBatch) DeleteOrphan(o orphan) error {
+	return b.batch.Delete(orphanRecordKey(o))
+}
+
+func (b *kvBatch) Commit(meta *treeMeta) error {
+	defer b.batch.Close()
+	if meta != nil {
+		bz, err := meta.bytes()
+		if err != nil {
+			return err
+		}
+		if err := b.batch.Set(metaKey, bz); err != nil {
+			return err
+		}
+	}
+	return b.batch.WriteSync()
 }
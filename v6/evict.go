@@ -0,0 +1,546 @@
+package v6
+
+import (
+	"container/list"
+	"fmt"
+)
+
+// evictionPolicy selects which frame of a full nodePool is replaced when a node is allocated or faulted
+// in. Frames are identified by their index in nodePool.nodes. Only frames for which nodePool.evictable
+// holds may be selected.
+type evictionPolicy interface {
+	// inserted is called after a node is placed in frame, either newly allocated or faulted from the db.
+	inserted(frame int)
+	// hit is called when the node in frame is accessed while resident.
+	hit(frame int)
+	// removed is called when frame is returned to the free list.
+	removed(frame int)
+	// evict returns a clean frame to be replaced. It is called when there are no free frames, or when a
+	// budgeted pool is over its budget.
+	evict() int
+}
+
+type evictionPolicyKind string
+
+const (
+	clockPolicyKind    evictionPolicyKind = "clock"
+	lruPolicyKind      evictionPolicyKind = "lru"
+	twoQueuePolicyKind evictionPolicyKind = "2q"
+	arcPolicyKind      evictionPolicyKind = "arc"
+	clockProPolicyKind evictionPolicyKind = "clock-pro"
+)
+
+var evictionPolicyKinds = []evictionPolicyKind{
+	clockPolicyKind, lruPolicyKind, twoQueuePolicyKind, arcPolicyKind, clockProPolicyKind,
+}
+
+func newEvictionPolicy(kind evictionPolicyKind, np *nodePool) evictionPolicy {
+	switch kind {
+	case clockPolicyKind:
+		return &clockPolicy{np: np}
+	case lruPolicyKind:
+		return newLRUPolicy(np)
+	case twoQueuePolicyKind:
+		return newTwoQueuePolicy(np)
+	case arcPolicyKind:
+		return newARCPolicy(np)
+	case clockProPolicyKind:
+		return newClockProPolicy(np)
+	default:
+		panic(fmt.Sprintf("unknown eviction policy %q", kind))
+	}
+}
+
+func (np *nodePool) evictable(frame int) bool {
+	n := np.nodes[frame]
+	// free frames hold no bytes and are not evictable.
+	return !n.dirty && !n.lock && np.pins[frame] == 0 && np.sizes[frame] > 0
+}
+
+// clockPolicy is CLOCK with the node's use bit as the reference bit.
+type clockPolicy struct {
+	np   *nodePool
+	hand int
+}
+
+func (c *clockPolicy) inserted(frame int) {
+	c.np.nodes[frame].use = true
+}
+
+func (c *clockPolicy) hit(frame int) {
+	c.np.nodes[frame].use = true
+}
+
+func (c *clockPolicy) removed(int) {}
+
+func (c *clockPolicy) evict() int {
+	np := c.np
+	itr := 0
+	for {
+		itr++
+		if itr > len(np.nodes)*2 {
+			panic("eviction failed, pool exhausted")
+		}
+
+		frame := c.hand
+		n := np.nodes[frame]
+		c.hand++
+		if c.hand == len(np.nodes) {
+			c.hand = 0
+		}
+
+		switch {
+		case n.use:
+			// always clear the use bit, dirty nodes included.
+			np.metrics.PoolEvictMiss++
+			n.use = false
+			continue
+		case !np.evictable(frame):
+			// never evict dirty, locked or pinned nodes
+			np.metrics.PoolEvictMiss++
+			continue
+		default:
+			return frame
+		}
+	}
+}
+
+// frameLinks holds the intrusive links of the frame lists of a policy. A frame is in at most one list
+// at a time so lists may share links.
+type frameLinks struct {
+	prev, next []int
+}
+
+func newFrameLinks(size int) *frameLinks {
+	return &frameLinks{
+		prev: make([]int, size),
+		next: make([]int, size),
+	}
+}
+
+// frameList is a doubly linked list of frames ordered from most (front) to least (back) recently used.
+type frameList struct {
+	links      *frameLinks
+	head, tail int
+	len        int
+}
+
+func newFrameList(links *frameLinks) *frameList {
+	return &frameList{links: links, head: -1, tail: -1}
+}
+
+func (l *frameList) pushFront(frame int) {
+	l.links.prev[frame] = -1
+	l.links.next[frame] = l.head
+	if l.head != -1 {
+		l.links.prev[l.head] = frame
+	}
+	l.head = frame
+	if l.tail == -1 {
+		l.tail = frame
+	}
+	l.len++
+}
+
+func (l *frameList) remove(frame int) {
+	prev, next := l.links.prev[frame], l.links.next[frame]
+	if prev != -1 {
+		l.links.next[prev] = next
+	} else {
+		l.head = next
+	}
+	if next != -1 {
+		l.links.prev[next] = prev
+	} else {
+		l.tail = prev
+	}
+	l.len--
+}
+
+func (l *frameList) moveToFront(frame int) {
+	if l.head == frame {
+		return
+	}
+	l.remove(frame)
+	l.pushFront(frame)
+}
+
+// evictBack removes and returns the least recently used evictable frame, or -1 if there is none.
+func (l *frameList) evictBack(np *nodePool) int {
+	for frame := l.tail; frame != -1; frame = l.links.prev[frame] {
+		if np.evictable(frame) {
+			l.remove(frame)
+			return frame
+		}
+		np.metrics.PoolEvictMiss++
+	}
+	return -1
+}
+
+// ghostList remembers the node keys of recently evicted frames, most recent at the front.
+type ghostList struct {
+	order *list.List
+	keys  map[nodeKey]*list.Element
+}
+
+func newGhostList() *ghostList {
+	return &ghostList{order: list.New(), keys: make(map[nodeKey]*list.Element)}
+}
+
+func (g *ghostList) push(nk *nodeKey) {
+	if nk == nil {
+		return
+	}
+	if e, ok := g.keys[*nk]; ok {
+		g.order.MoveToFront(e)
+		return
+	}
+	g.keys[*nk] = g.order.PushFront(*nk)
+}
+
+// take removes nk from the list and reports whether it was present.
+func (g *ghostList) take(nk *nodeKey) bool {
+	if nk == nil {
+		return false
+	}
+	e, ok := g.keys[*nk]
+	if ok {
+		g.order.Remove(e)
+		delete(g.keys, *nk)
+	}
+	return ok
+}
+
+func (g *ghostList) trim(size int) {
+	for g.order.Len() > size {
+		e := g.order.Back()
+		g.order.Remove(e)
+		delete(g.keys, e.Value.(nodeKey))
+	}
+}
+
+func (g *ghostList) len() int {
+	return g.order.Len()
+}
+
+// lruPolicy evicts the least recently used clean frame.
+type lruPolicy struct {
+	np  *nodePool
+	lru *frameList
+}
+
+func newLRUPolicy(np *nodePool) *lruPolicy {
+	return &lruPolicy{np: np, lru: newFrameList(newFrameLinks(len(np.nodes)))}
+}
+
+func (p *lruPolicy) inserted(frame int) {
+	p.lru.pushFront(frame)
+}
+
+func (p *lruPolicy) hit(frame int) {
+	p.lru.moveToFront(frame)
+}
+
+func (p *lruPolicy) removed(frame int) {
+	p.lru.remove(frame)
+}
+
+func (p *lruPolicy) evict() int {
+	frame := p.lru.evictBack(p.np)
+	if frame == -1 {
+		panic("eviction failed, pool exhausted")
+	}
+	return frame
+}
+
+// twoQueuePolicy is the full 2Q algorithm of Johnson and Shasha. First time nodes enter the FIFO a1in;
+// nodes faulted again while remembered by the ghost queue a1out are admitted to the LRU am.
+type twoQueuePolicy struct {
+	np        *nodePool
+	where     []*frameList
+	a1in, am  *frameList
+	a1out     *ghostList
+	kin, kout int
+}
+
+func newTwoQueuePolicy(np *nodePool) *twoQueuePolicy {
+	links := newFrameLinks(len(np.nodes))
+	return &twoQueuePolicy{
+		np:    np,
+		where: make([]*frameList, len(np.nodes)),
+		a1in:  newFrameList(links),
+		am:    newFrameList(links),
+		a1out: newGhostList(),
+		kin:   maxInt(len(np.nodes)/4, 1),
+		kout:  maxInt(len(np.nodes)/2, 1),
+	}
+}
+
+func (p *twoQueuePolicy) inserted(frame int) {
+	l := p.a1in
+	if p.a1out.take(p.np.nodes[frame].nodeKey) {
+		l = p.am
+	}
+	l.pushFront(frame)
+	p.where[frame] = l
+}
+
+func (p *twoQueuePolicy) hit(frame int) {
+	// hits in a1in are correlated references and do not change its FIFO order.
+	if p.where[frame] == p.am {
+		p.am.moveToFront(frame)
+	}
+}
+
+func (p *twoQueuePolicy) removed(frame int) {
+	p.where[frame].remove(frame)
+	p.where[frame] = nil
+}
+
+func (p *twoQueuePolicy) evict() int {
+	first, second := p.am, p.a1in
+	if p.a1in.len > p.kin {
+		first, second = p.a1in, p.am
+	}
+	frame := first.evictBack(p.np)
+	if frame == -1 {
+		frame = second.evictBack(p.np)
+	}
+	if frame == -1 {
+		panic("eviction failed, pool exhausted")
+	}
+	if p.where[frame] == p.a1in {
+		p.a1out.push(p.np.nodes[frame].nodeKey)
+		p.a1out.trim(p.kout)
+	}
+	p.where[frame] = nil
+	return frame
+}
+
+// arcPolicy is the Adaptive Replacement Cache of Megiddo and Modha. t1 holds frames seen once and t2
+// frames seen at least twice; the ghost lists b1 and b2 steer the target size p of t1. Since the
+// incoming node is only known after a frame is chosen, p is adapted on insert rather than before
+// replacement.
+type arcPolicy struct {
+	np     *nodePool
+	where  []*frameList
+	t1, t2 *frameList
+	b1, b2 *ghostList
+	p, c   int
+}
+
+func newARCPolicy(np *nodePool) *arcPolicy {
+	links := newFrameLinks(len(np.nodes))
+	return &arcPolicy{
+		np:    np,
+		where: make([]*frameList, len(np.nodes)),
+		t1:    newFrameList(links),
+		t2:    newFrameList(links),
+		b1:    newGhostList(),
+		b2:    newGhostList(),
+		c:     len(np.nodes),
+	}
+}
+
+func (p *arcPolicy) inserted(frame int) {
+	nk := p.np.nodes[frame].nodeKey
+	switch {
+	case p.b1.take(nk):
+		p.p = minInt(p.c, p.p+maxInt(p.b2.len()/maxInt(p.b1.len(), 1), 1))
+		p.t2.pushFront(frame)
+		p.where[frame] = p.t2
+	case p.b2.take(nk):
+		p.p = maxInt(0, p.p-maxInt(p.b1.len()/maxInt(p.b2.len(), 1), 1))
+		p.t2.pushFront(frame)
+		p.where[frame] = p.t2
+	default:
+		p.t1.pushFront(frame)
+		p.where[frame] = p.t1
+	}
+	p.b1.trim(maxInt(p.c-p.t1.len, 0))
+	p.b2.trim(maxInt(2*p.c-p.t1.len-p.t2.len-p.b1.len(), 0))
+}
+
+func (p *arcPolicy) hit(frame int) {
+	p.where[frame].remove(frame)
+	p.t2.pushFront(frame)
+	p.where[frame] = p.t2
+}
+
+func (p *arcPolicy) removed(frame int) {
+	p.where[frame].remove(frame)
+	p.where[frame] = nil
+}
+
+func (p *arcPolicy) evict() int {
+	first, second := p.t2, p.t1
+	if p.t1.len > 0 && (p.t1.len > p.p || p.t2.len == 0) {
+		first, second = p.t1, p.t2
+	}
+	frame := first.evictBack(p.np)
+	if frame == -1 {
+		frame = second.evictBack(p.np)
+	}
+	if frame == -1 {
+		panic("eviction failed, pool exhausted")
+	}
+	if p.where[frame] == p.t1 {
+		p.b1.push(p.np.nodes[frame].nodeKey)
+	} else {
+		p.b2.push(p.np.nodes[frame].nodeKey)
+	}
+	p.where[frame] = nil
+	return frame
+}
+
+// clockProPolicy is a simplified CLOCK-Pro of Jiang, Chen and Zhang. Frames are hot or cold and the
+// node's use bit is the reference bit. Cold frames start a test period when faulted in; a cold frame
+// referenced during its test period is promoted to hot, and a node faulted in while its evicted cold
+// frame is still in test (tracked by the ghost list) grows the cold target and is admitted hot.
+// Expired tests shrink the cold target.
+type clockProPolicy struct {
+	np        *nodePool
+	hot, test []bool
+	resident  []bool
+	hotCount  int
+	coldHand  int
+	hotHand   int
+	coldTgt   int
+	ghost     *ghostList
+	ghostSize int
+}
+
+func newClockProPolicy(np *nodePool) *clockProPolicy {
+	size := len(np.nodes)
+	return &clockProPolicy{
+		np:        np,
+		hot:       make([]bool, size),
+		test:      make([]bool, size),
+		resident:  make([]bool, size),
+		coldTgt:   maxInt(size/2, 1),
+		ghost:     newGhostList(),
+		ghostSize: size,
+	}
+}
+
+func (p *clockProPolicy) inserted(frame int) {
+	n := p.np.nodes[frame]
+	n.use = false
+	p.resident[frame] = true
+	if p.ghost.take(n.nodeKey) {
+		p.coldTgt = minInt(p.coldTgt+1, len(p.hot)-1)
+		p.promote(frame)
+		return
+	}
+	p.hot[frame] = false
+	p.test[frame] = true
+}
+
+func (p *clockProPolicy) hit(frame int) {
+	p.np.nodes[frame].use = true
+}
+
+func (p *clockProPolicy) removed(frame int) {
+	if p.hot[frame] {
+		p.hotCount--
+	}
+	p.hot[frame] = false
+	p.test[frame] = false
+	p.resident[frame] = false
+}
+
+func (p *clockProPolicy) promote(frame int) {
+	p.hot[frame] = true
+	p.test[frame] = false
+	p.hotCount++
+	if p.hotCount > len(p.hot)-p.coldTgt {
+		p.runHotHand()
+	}
+}
+
+// runHotHand demotes one hot frame which has not been referenced since the hand last passed it,
+// terminating the test periods of cold frames along the way.
+func (p *clockProPolicy) runHotHand() {
+	np := p.np
+	for i := 0; i < 2*len(p.hot); i++ {
+		frame := p.hotHand
+		p.hotHand = (p.hotHand + 1) % len(p.hot)
+		if !p.resident[frame] {
+			continue
+		}
+		n := np.nodes[frame]
+		if !p.hot[frame] {
+			p.test[frame] = false
+			continue
+		}
+		if n.use {
+			n.use = false
+			continue
+		}
+		p.hot[frame] = false
+		p.hotCount--
+		return
+	}
+}
+
+func (p *clockProPolicy) evict() int {
+	np := p.np
+	for i := 0; i < 4*len(p.hot); i++ {
+		if i > 0 && i%len(p.hot) == 0 {
+			// a full pass found no clean cold frame, e.g. because the cold frames are dirty or pinned.
+			// grow the cold target past the current cold frames and demote hot frames to fit it.
+			p.coldTgt = minInt(maxInt(p.coldTgt*2, len(p.hot)-p.hotCount+1), len(p.hot)-1)
+			for j := 0; j < len(p.hot) && p.hotCount > len(p.hot)-p.coldTgt; j++ {
+				p.runHotHand()
+			}
+		}
+		frame := p.coldHand
+		p.coldHand = (p.coldHand + 1) % len(p.hot)
+		if !p.resident[frame] {
+			continue
+		}
+		n := np.nodes[frame]
+		if p.hot[frame] {
+			continue
+		}
+		switch {
+		case n.use:
+			np.metrics.PoolEvictMiss++
+			n.use = false
+			if p.test[frame] {
+				p.promote(frame)
+			} else {
+				p.test[frame] = true
+			}
+		case !np.evictable(frame):
+			np.metrics.PoolEvictMiss++
+		default:
+			if p.test[frame] {
+				p.ghost.push(n.nodeKey)
+				if p.ghost.len() > p.ghostSize {
+					// the oldest test period expired without a re-reference.
+					p.ghost.trim(p.ghostSize)
+					p.coldTgt = maxInt(p.coldTgt-1, 1)
+				}
+			}
+			p.test[frame] = false
+			p.resident[frame] = false
+			return frame
+		}
+	}
+	panic("eviction failed, pool exhausted")
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,181 @@
+package v6
+
+import (
+	"bytes"
+	"errors"
+
+	dbm "github.com/cosmos/cosmos-db"
+)
+
+var _ dbm.Iterator = (*Iterator)(nil)
+
+// Iterator walks the leaves of a MutableTree in key order over the domain [start, end). Nodes are
+// faulted into the pool as they are reached and pinned while held on the stack, so an Iterator must be
+// exhausted or closed. The tree must not be mutated while an Iterator is open.
+type Iterator struct {
+	tree       *MutableTree
+	start, end []byte
+	ascending  bool
+
+	// stack holds the nodes which are yet to be visited.
+	stack []*Node
+	key   []byte
+	value []byte
+	valid bool
+	err   error
+}
+
+// Iterator returns an iterator over the domain [start, end) of the working tree. A nil start or end
+// leaves that side of the domain unbounded.
+func (tree *MutableTree) Iterator(start, end []byte, ascending bool) (*Iterator, error) {
+	if (start != nil && len(start) == 0) || (end != nil && len(end) == 0) {
+		return nil, errors.New("iterator key is empty")
+	}
+	itr := &Iterator{
+		tree:      tree,
+		start:     start,
+		end:       end,
+		ascending: ascending,
+		valid:     true,
+	}
+	if tree.root != nil {
+		itr.push(tree.root)
+	}
+	itr.Next()
+	return itr, nil
+}
+
+func (itr *Iterator) Domain() (start []byte, end []byte) {
+	return itr.start, itr.end
+}
+
+func (itr *Iterator) Valid() bool {
+	return itr.valid
+}
+
+// Next advances to the next leaf in the domain, faulting inner nodes and their children into the pool
+// as needed.
+func (itr *Iterator) Next() {
+	for len(itr.stack) > 0 {
+		node := itr.stack[len(itr.stack)-1]
+		itr.stack = itr.stack[:len(itr.stack)-1]
+		itr.tree.pool.Unpin(node)
+
+		if node.isLeaf() {
+			if itr.ascending && itr.end != nil && bytes.Compare(node.key, itr.end) >= 0 {
+				break
+			}
+			if !itr.ascending && itr.start != nil && bytes.Compare(node.key, itr.start) < 0 {
+				break
+			}
+			if itr.inDomain(node.key) {
+				itr.key = node.key
+				itr.value = node.value
+				return
+			}
+			continue
+		}
+
+		if err := itr.pushChildren(node); err != nil {
+			itr.err = err
+			break
+		}
+	}
+
+	itr.valid = false
+	itr.key = nil
+	itr.value = nil
+	itr.release()
+}
+
+func (itr *Iterator) push(node *Node) {
+	itr.tree.pool.Pin(node)
+	itr.stack = append(itr.stack, node)
+}
+
+// release unpins the nodes remaining on the stack.
+func (itr *Iterator) release() {
+	for _, node := range itr.stack {
+		itr.tree.pool.Unpin(node)
+	}
+	itr.stack = nil
+}
+
+// pushChildren pushes the children of node which may hold keys in the domain onto the stack, ordered
+// so that the next leaf in iteration order is popped first.
+func (itr *Iterator) pushChildren(node *Node) error {
+	// node.key is the smallest key in the right subtree.
+	visitLeft := itr.start == nil || bytes.Compare(itr.start, node.key) < 0
+	visitRight := itr.end == nil || bytes.Compare(node.key, itr.end) < 0
+
+	// node itself was popped from the stack, keep it resident while its children are faulted in.
+	itr.tree.pool.Pin(node)
+	defer itr.tree.pool.Unpin(node)
+
+	var left, right *Node
+	if visitLeft {
+		var err error
+		if left, err = node.getLeftNode(itr.tree); err != nil {
+			return err
+		}
+		itr.tree.pool.Pin(left)
+		defer itr.tree.pool.Unpin(left)
+	}
+	if visitRight {
+		var err error
+		if right, err = node.getRightNode(itr.tree); err != nil {
+			return err
+		}
+	}
+
+	if itr.ascending {
+		if visitRight {
+			itr.push(right)
+		}
+		if visitLeft {
+			itr.push(left)
+		}
+	} else {
+		if visitLeft {
+			itr.push(left)
+		}
+		if visitRight {
+			itr.push(right)
+		}
+	}
+	return nil
+}
+
+func (itr *Iterator) inDomain(key []byte) bool {
+	if itr.start != nil && bytes.Compare(key, itr.start) < 0 {
+		return false
+	}
+	if itr.end != nil && bytes.Compare(key, itr.end) >= 0 {
+		return false
+	}
+	return true
+}
+
+func (itr *Iterator) Key() (key []byte) {
+	if !itr.valid {
+		panic("iterator is invalid")
+	}
+	return itr.key
+}
+
+func (itr *Iterator) Value() (value []byte) {
+	if !itr.valid {
+		panic("iterator is invalid")
+	}
+	return itr.value
+}
+
+func (itr *Iterator) Error() error {
+	return itr.err
+}
+
+func (itr *Iterator) Close() error {
+	itr.valid = false
+	itr.release()
+	return itr.err
+}
@@ -1,8 +1,10 @@
 package v6
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 
@@ -65,13 +67,14 @@ func (node *Node) getLeftNode(t *MutableTree) (*Node, error) {
 		if node.leftNodeKey == nil {
 			return nil, fmt.Errorf("left node key is nil")
 		}
-		node.leftNode = t.db.Get(*node.leftNodeKey)
-		if node.leftNode == nil {
-			return nil, fmt.Errorf("left node is nil; fetch failed")
+		var err error
+		node.leftNode, err = t.fetchNode(node.leftNodeKey)
+		if err != nil {
+			return nil, fmt.Errorf("left node fetch failed; %w", err)
 		}
-		t.pool.Put(node.leftNode)
+	} else {
+		t.pool.Hit(node.leftNode)
 	}
-	node.leftNode.use = true
 	return node.leftNode, nil
 }
 
@@ -98,13 +101,14 @@ func (node *Node) getRightNode(t *MutableTree) (*Node, error) {
 		if node.rightNodeKey == nil {
 			return nil, fmt.Errorf("right node key is nil")
 		}
-		node.rightNode = t.db.Get(*node.rightNodeKey)
-		if node.rightNode == nil {
-			return nil, fmt.Errorf("right node is nil; fetch failed")
+		var err error
+		node.rightNode, err = t.fetchNode(node.rightNodeKey)
+		if err != nil {
+			return nil, fmt.Errorf("right node fetch failed; %w", err)
 		}
-		t.pool.Put(node.rightNode)
+	} else {
+		t.pool.Hit(node.rightNode)
 	}
-	node.rightNode.use = true
 	return node.rightNode, nil
 }
 
@@ -121,6 +125,63 @@ func (node *Node) setRight(rightNode *Node) {
 	node.rightNode = rightNode
 }
 
+// get returns the index and value of key in the subtree rooted at node. If key is not present the
+// returned index is the position it would occupy and value is nil.
+func (node *Node) get(t *MutableTree, key []byte) (index int64, value []byte, err error) {
+	for !node.isLeaf() {
+		if bytes.Compare(key, node.key) < 0 {
+			node, err = node.getLeftNode(t)
+			if err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+		size := node.size
+		node, err = node.getRightNode(t)
+		if err != nil {
+			return 0, nil, err
+		}
+		index += size - node.size
+	}
+
+	switch bytes.Compare(node.key, key) {
+	case -1:
+		return index + 1, nil, nil
+	case 1:
+		return index, nil, nil
+	default:
+		return index, node.value, nil
+	}
+}
+
+// getByIndex returns the key and value of the leaf at index in the subtree rooted at node, or nil if
+// index is out of range.
+func (node *Node) getByIndex(t *MutableTree, index int64) (key []byte, value []byte, err error) {
+	for !node.isLeaf() {
+		// keep node resident to descend right after faulting in its left child.
+		t.pool.Pin(node)
+		left, err := node.getLeftNode(t)
+		t.pool.Unpin(node)
+		if err != nil {
+			return nil, nil, err
+		}
+		if index < left.size {
+			node = left
+			continue
+		}
+		index -= left.size
+		node, err = node.getRightNode(t)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if index == 0 {
+		return node.key, node.value, nil
+	}
+	return nil, nil, nil
+}
+
 // NOTE: mutates height and size
 func (node *Node) calcHeightAndSize(t *MutableTree) error {
 	leftNode, err := node.getLeftNode(t)
@@ -128,6 +189,8 @@ func (node *Node) calcHeightAndSize(t *MutableTree) error {
 		return err
 	}
 
+	t.pool.Pin(leftNode)
+	defer t.pool.Unpin(leftNode)
 	rightNode, err := node.getRightNode(t)
 	if err != nil {
 		return err
@@ -220,11 +283,16 @@ func (tree *MutableTree) balance(node *Node) (newSelf *Node, err error) {
 }
 
 func (node *Node) calcBalance(t *MutableTree) (int, error) {
+	// node may be a clean child, keep it resident while its children are faulted in.
+	t.pool.Pin(node)
+	defer t.pool.Unpin(node)
 	leftNode, err := node.getLeftNode(t)
 	if err != nil {
 		return 0, err
 	}
 
+	t.pool.Pin(leftNode)
+	defer t.pool.Unpin(leftNode)
 	rightNode, err := node.getRightNode(t)
 	if err != nil {
 		return 0, err
@@ -237,11 +305,15 @@ func (node *Node) calcBalance(t *MutableTree) (int, error) {
 func (tree *MutableTree) rotateRight(node *Node) (*Node, error) {
 	var err error
 	// TODO: optimize balance & rotate.
-	tree.addOrphan(node)
+	if err = tree.addOrphan(node); err != nil {
+		return nil, err
+	}
 	tree.mutateNode(node)
 
-	tree.addOrphan(node.left(tree))
 	newNode := node.left(tree)
+	if err = tree.addOrphan(newNode); err != nil {
+		return nil, err
+	}
 	tree.mutateNode(newNode)
 
 	node.setLeft(newNode.right(tree))
@@ -264,11 +336,15 @@ func (tree *MutableTree) rotateRight(node *Node) (*Node, error) {
 func (tree *MutableTree) rotateLeft(node *Node) (*Node, error) {
 	var err error
 	// TODO: optimize balance & rotate.
-	tree.addOrphan(node)
+	if err = tree.addOrphan(node); err != nil {
+		return nil, err
+	}
 	tree.mutateNode(node)
 
-	tree.addOrphan(node.right(tree))
 	newNode := node.right(tree)
+	if err = tree.addOrphan(newNode); err != nil {
+		return nil, err
+	}
 	tree.mutateNode(newNode)
 
 	node.setRight(newNode.left(tree))
@@ -397,6 +473,157 @@ func (node *Node) writeHashBytes2(tree *MutableTree, w io.Writer, version int64)
 	return nil
 }
 
+// writeBytes writes the node in its persisted form, which is the v1 encoding with child node keys always
+// in the non-legacy mode.
+func (node *Node) writeBytes(w io.Writer) error {
+	if node == nil {
+		return errors.New("cannot write nil node")
+	}
+	err := encoding.EncodeVarint(w, int64(node.subtreeHeight))
+	if err != nil {
+		return fmt.Errorf("writing height, %w", err)
+	}
+	err = encoding.EncodeVarint(w, node.size)
+	if err != nil {
+		return fmt.Errorf("writing size, %w", err)
+	}
+
+	// Unlike writeHashBytes, key is written for inner nodes.
+	err = encoding.EncodeBytes(w, node.key)
+	if err != nil {
+		return fmt.Errorf("writing key, %w", err)
+	}
+
+	if node.isLeaf() {
+		err = encoding.EncodeBytes(w, node.value)
+		if err != nil {
+			return fmt.Errorf("writing value, %w", err)
+		}
+		return nil
+	}
+
+	err = encoding.EncodeBytes(w, node.hash)
+	if err != nil {
+		return fmt.Errorf("writing hash, %w", err)
+	}
+	// mode; legacy node keys are never written.
+	err = encoding.EncodeVarint(w, 0)
+	if err != nil {
+		return fmt.Errorf("writing mode, %w", err)
+	}
+	if node.leftNodeKey == nil {
+		return fmt.Errorf("left node key is nil")
+	}
+	err = encoding.EncodeVarint(w, node.leftNodeKey.Version())
+	if err != nil {
+		return fmt.Errorf("writing the version of left node key, %w", err)
+	}
+	err = encoding.EncodeVarint(w, int64(node.leftNodeKey.Sequence()))
+	if err != nil {
+		return fmt.Errorf("writing the sequence of left node key, %w", err)
+	}
+	if node.rightNodeKey == nil {
+		return fmt.Errorf("right node key is nil")
+	}
+	err = encoding.EncodeVarint(w, node.rightNodeKey.Version())
+	if err != nil {
+		return fmt.Errorf("writing the version of right node key, %w", err)
+	}
+	err = encoding.EncodeVarint(w, int64(node.rightNodeKey.Sequence()))
+	if err != nil {
+		return fmt.Errorf("writing the sequence of right node key, %w", err)
+	}
+	return nil
+}
+
+// MakeNode decodes a node written by writeBytes.
+func MakeNode(nk *nodeKey, buf []byte) (*Node, error) {
+	// Read node header (height, size, key).
+	height, n, err := encoding.DecodeVarint(buf)
+	if err != nil {
+		return nil, fmt.Errorf("decoding node.height, %w", err)
+	}
+	buf = buf[n:]
+	height8 := int8(height)
+	if height != int64(height8) {
+		return nil, errors.New("invalid height, out of int8 range")
+	}
+
+	size, n, err := encoding.DecodeVarint(buf)
+	if err != nil {
+		return nil, fmt.Errorf("decoding node.size, %w", err)
+	}
+	buf = buf[n:]
+
+	key, n, err := encoding.DecodeBytes(buf)
+	if err != nil {
+		return nil, fmt.Errorf("decoding node.key, %w", err)
+	}
+	buf = buf[n:]
+
+	node := &Node{
+		subtreeHeight: height8,
+		size:          size,
+		nodeKey:       nk,
+		key:           key,
+		frameId:       -1,
+	}
+
+	// Read node body.
+	if node.isLeaf() {
+		val, _, err := encoding.DecodeBytes(buf)
+		if err != nil {
+			return nil, fmt.Errorf("decoding node.value, %w", err)
+		}
+		node.value = val
+		// ensure take the hash for the leaf node
+		node._hash(nil, nk.Version())
+		return node, nil
+	}
+
+	// Read children.
+	node.hash, n, err = encoding.DecodeBytes(buf)
+	if err != nil {
+		return nil, fmt.Errorf("decoding node.hash, %w", err)
+	}
+	buf = buf[n:]
+
+	mode, n, err := encoding.DecodeVarint(buf)
+	if err != nil {
+		return nil, fmt.Errorf("decoding mode, %w", err)
+	}
+	buf = buf[n:]
+	if mode != 0 {
+		return nil, fmt.Errorf("unsupported mode %d", mode)
+	}
+
+	node.leftNodeKey, n, err = decodeNodeKey(buf)
+	if err != nil {
+		return nil, fmt.Errorf("decoding node.leftNodeKey, %w", err)
+	}
+	buf = buf[n:]
+	node.rightNodeKey, _, err = decodeNodeKey(buf)
+	if err != nil {
+		return nil, fmt.Errorf("decoding node.rightNodeKey, %w", err)
+	}
+	return node, nil
+}
+
+func decodeNodeKey(buf []byte) (*nodeKey, int, error) {
+	version, n, err := encoding.DecodeVarint(buf)
+	if err != nil {
+		return nil, 0, fmt.Errorf("decoding version, %w", err)
+	}
+	sequence, m, err := encoding.DecodeVarint(buf[n:])
+	if err != nil {
+		return nil, 0, fmt.Errorf("decoding sequence, %w", err)
+	}
+	if sequence != int64(uint32(sequence)) {
+		return nil, 0, errors.New("invalid sequence, out of uint32 range")
+	}
+	return newNodeKey(version, uint32(sequence)), n + m, nil
+}
+
 func (node *Node) isLeaf() bool {
 	return node.subtreeHeight == 0
 }
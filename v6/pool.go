@@ -2,73 +2,130 @@ package v6
 
 import (
 	"fmt"
+	"unsafe"
 
 	"github.com/kocubinski/iavlite/core"
 )
 
+// nodeOverhead is the memory held by a node apart from its key, value and hash: the struct and the
+// arrays of its three node keys.
+const nodeOverhead = int64(unsafe.Sizeof(Node{})) + 3*nodeKeySize
+
+// budgetFrameBytes is the key, value and hash bytes of an average node which sizes the frames of a
+// budgeted pool. Pools of smaller nodes are bounded by frames rather than bytes.
+const budgetFrameBytes = 64
+
 type nodePool struct {
-	db        *memDB
-	free      chan int
-	nodes     []*Node
-	metrics   *core.TreeMetrics
-	evict     func(*nodePool) *Node
-	clockHand int
-
-	dirtyCount int
-	lockCount  int
-}
-
-func (np *nodePool) clockEvict() *Node {
-	itr := 0
-	for {
-		itr++
-		if itr > len(np.nodes)*2 {
-			panic("eviction failed, pool exhausted")
-		}
+	db      nodeDB
+	free    chan int
+	nodes   []*Node
+	metrics *core.TreeMetrics
+	policy  evictionPolicy
 
-		n := np.nodes[np.clockHand]
-		np.clockHand++
-		if np.clockHand == len(np.nodes) {
-			np.clockHand = 0
-		}
+	// pins holds the pin count of each frame. pinned frames are never evicted.
+	pins []int32
 
-		switch {
-		case n.use:
-			// always clear the use bit, dirty nodes included.
-			np.metrics.PoolEvictMiss++
-			n.use = false
-			continue
-		case n.dirty:
-			// never evict dirty nodes
-			np.metrics.PoolEvictMiss++
-			continue
-		default:
-			np.metrics.PoolEvict++
-			n.clear()
-			return n
-		}
-	}
+	// budget is the memory in bytes the resident nodes may hold, or 0 for no limit besides the frames.
+	// sizes holds the bytes accounted to each frame, which is 0 for free frames.
+	budget int64
+	sizes  []int64
+	bytes  int64
+
+	dirtyCount    int
+	lockCount     int
+	residentCount int
+	pinnedCount   int
 }
 
-func newNodePool(db *memDB, size int) *nodePool {
+// evict clears and returns the node in the frame selected by the eviction policy.
+func (np *nodePool) evict() *Node {
+	n := np.nodes[np.policy.evict()]
+	np.metrics.PoolEvict++
+	np.release(n.frameId)
+	n.clear()
+	return n
+}
+
+func newNodePool(db nodeDB, size int, policy evictionPolicyKind) *nodePool {
 	np := &nodePool{
 		nodes: make([]*Node, size),
 		free:  make(chan int, size),
 		db:    db,
+		pins:  make([]int32, size),
+		sizes: make([]int64, size),
 	}
 	for i := 0; i < size; i++ {
 		np.free <- i
 		np.nodes[i] = &Node{frameId: i}
 	}
+	np.policy = newEvictionPolicy(policy, np)
+	return np
+}
+
+// newBudgetedNodePool returns a pool which evicts nodes to keep the memory they hold within budget
+// bytes. Its frames fit budget in nodes of budgetFrameBytes.
+func newBudgetedNodePool(db nodeDB, budget int64, policy evictionPolicyKind) *nodePool {
+	size := int(budget / (nodeOverhead + budgetFrameBytes))
+	if size < 1 {
+		panic(fmt.Sprintf("pool budget of %d bytes is too small", budget))
+	}
+	np := newNodePool(db, size, policy)
+	np.budget = budget
 	return np
 }
 
+func nodeBytes(n *Node) int64 {
+	return nodeOverhead + int64(len(n.key)+len(n.value)+len(n.hash))
+}
+
+// account updates the bytes held by the frame of n. Nodes are accounted when placed in a frame and
+// when hashed, so bytes lag in-place changes of the working tree until the next SaveVersion.
+func (np *nodePool) account(n *Node) {
+	if n.overflow {
+		return
+	}
+	size := nodeBytes(n)
+	if np.sizes[n.frameId] == 0 {
+		np.residentCount++
+	}
+	np.bytes += size - np.sizes[n.frameId]
+	np.sizes[n.frameId] = size
+	np.metrics.PoolBytes = np.bytes
+	np.metrics.PoolResident = int64(np.residentCount)
+}
+
+// release drops the bytes accounted to frame once its node is evicted or returned.
+func (np *nodePool) release(frame int) {
+	if np.sizes[frame] == 0 {
+		return
+	}
+	np.residentCount--
+	np.bytes -= np.sizes[frame]
+	np.sizes[frame] = 0
+	np.metrics.PoolBytes = np.bytes
+	np.metrics.PoolResident = int64(np.residentCount)
+}
+
+// shrink evicts nodes to the free list until the pool is within budget. Dirty, locked and pinned nodes
+// can't be evicted, so the pool may stay over budget until they are flushed or unpinned.
+func (np *nodePool) shrink() {
+	if np.budget == 0 {
+		return
+	}
+	// a lower bound of the evictable frames since the dirty, locked and pinned ones may overlap.
+	for np.bytes > np.budget && np.residentCount-np.dirtyCount-np.lockCount-np.pinnedCount > 0 {
+		n := np.evict()
+		np.free <- n.frameId
+	}
+}
+
 func (np *nodePool) Get() *Node {
 	np.metrics.PoolGet++
 
 	// TODO
 	// soft ceiling: test/configure different fractions
-	if np.dirtyCount > len(np.nodes)/2 {
+	// nodes locked by a checkpoint in progress can't be evicted either.
+	if np.dirtyCount+np.lockCount > len(np.nodes)/2 {
 		np.metrics.PoolDirtyOverflow++
 		// allocate a new node. it will be discarded on next flush
 		n := &Node{overflow: true}
@@ -77,13 +134,15 @@ func (np *nodePool) Get() *Node {
 
 	var n *Node
 	if len(np.free) == 0 {
-		n = np.clockEvict()
+		n = np.evict()
 	} else {
 		id := <-np.free
 		n = np.nodes[id]
 	}
-	n.use = true
+	np.policy.inserted(n.frameId)
 	np.dirtyNode(n)
+	np.account(n)
+	np.shrink()
 
 	return n
 }
@@ -98,6 +157,16 @@ func (np *nodePool) Return(n *Node) {
 		// overflow nodes are not managed
 		return
 	}
+	if np.pins[n.frameId] != 0 {
+		panic(fmt.Sprintf("nodePool.Return() of pinned node in frame %d", n.frameId))
+	}
+	if n.lock {
+		// the checkpoint flushes a copy, the frame may be reused right away.
+		n.lock = false
+		np.lockCount--
+	}
+	np.policy.removed(n.frameId)
+	np.release(n.frameId)
 	np.free <- n.frameId
 	np.metrics.PoolReturn++
 	n.clear()
@@ -108,7 +177,7 @@ func (np *nodePool) Put(n *Node) {
 	np.metrics.PoolFault++
 	var frameId int
 	if len(np.free) == 0 {
-		frameId = np.clockEvict().frameId
+		frameId = np.evict().frameId
 	} else {
 		frameId = <-np.free
 	}
@@ -119,19 +188,68 @@ func (np *nodePool) Put(n *Node) {
 		panic("nodePool.Put() with nil node")
 	}
 	n.frameId = frameId
-	n.use = true
+	np.policy.inserted(frameId)
+	np.account(n)
+
+	// keep n resident while making room for it.
+	np.pins[frameId]++
+	np.pinnedCount++
+	np.shrink()
+	np.pins[frameId]--
+	np.pinnedCount--
+}
+
+// Hit records an access to n while resident in the pool.
+func (np *nodePool) Hit(n *Node) {
+	if n.overflow {
+		return
+	}
+	np.metrics.PoolHit++
+	np.policy.hit(n.frameId)
+}
+
+// Pin keeps n resident in the pool until a matching call to Unpin. Pins are counted so a node may be
+// pinned by several holders at once, e.g. the root by the tree and an open iterator. A pinned node must
+// be unpinned by every holder before it is returned to the pool.
+func (np *nodePool) Pin(n *Node) {
+	if n.overflow {
+		// overflow nodes are never evicted
+		return
+	}
+	if np.pins[n.frameId] == 0 {
+		np.pinnedCount++
+	}
+	np.pins[n.frameId]++
+}
+
+func (np *nodePool) Unpin(n *Node) {
+	if n.overflow {
+		return
+	}
+	if np.pins[n.frameId] == 0 {
+		panic(fmt.Sprintf("nodePool.Unpin() of unpinned node in frame %d", n.frameId))
+	}
+	np.pins[n.frameId]--
+	if np.pins[n.frameId] == 0 {
+		np.pinnedCount--
+	}
 }
 
-func (np *nodePool) FlushNode(n *Node) {
+func (np *nodePool) FlushNode(n *Node) error {
 	switch {
 	case n.dirty:
-		np.db.Set(n)
+		if err := np.db.Set(n); err != nil {
+			return err
+		}
 		np.cleanNode(n)
 	case n.overflow:
-		np.db.Set(n)
+		if err := np.db.Set(n); err != nil {
+			return err
+		}
 	default:
 		panic("strange, flushing a clean node")
 	}
+	return nil
 }
 
 func (np *nodePool) cleanNode(n *Node) {
@@ -150,13 +268,25 @@ func (np *nodePool) dirtyNode(n *Node) {
 	np.dirtyCount++
 }
 
-func (np *nodePool) lockDirty() {
+// lockDirty returns copies of the dirty nodes and overflow for a checkpoint to flush, and marks the
+// nodes clean. Until unlockDirty is called after the copies are written the nodes are locked, which keeps
+// them from being evicted and faulted back from the db before it has them. They may still be mutated
+// since the checkpoint only sees the copies.
+func (np *nodePool) lockDirty(overflow []*Node) []Node {
+	var nodes []Node
 	for _, n := range np.nodes {
 		if n.dirty {
+			nodes = append(nodes, *n)
+			np.cleanNode(n)
 			n.lock = true
 			np.lockCount++
 		}
 	}
+	for _, n := range overflow {
+		nodes = append(nodes, *n)
+		np.cleanNode(n)
+	}
+	return nodes
 }
 
 func (np *nodePool) unlockDirty() error {
@@ -174,19 +304,21 @@ func (np *nodePool) unlockDirty() error {
 	return nil
 }
 
-func (np *nodePool) checkpoint(overflow []*Node) error {
+// lockSaved is lockDirty for the dirty nodes which have been saved, for a writeback ahead of the next
+// checkpoint. Saved nodes are only modified in place after mutateNode clears their node key, so they may
+// be written before the checkpoint and their frames evicted once the copies are committed.
+func (np *nodePool) lockSaved() []Node {
+	var nodes []Node
 	for _, n := range np.nodes {
-		if n.dirty {
-			np.FlushNode(n)
+		if n.dirty && n.nodeKey != nil {
+			nodes = append(nodes, *n)
+			np.cleanNode(n)
+			n.lock = true
+			np.lockCount++
+			np.metrics.PoolWriteback++
 		}
 	}
-	for _, n := range overflow {
-		np.FlushNode(n)
-	}
-	//if np.dirtyCount != 0 {
-	//	return fmt.Errorf("dirty count mismatch: %d != 0", np.dirtyCount)
-	//}
-	return nil
+	return nodes
 }
 
 func (node *Node) clear() {
@@ -4,21 +4,115 @@ import (
 	"bytes"
 	"fmt"
 
+	dbm "github.com/cosmos/cosmos-db"
 	"github.com/kocubinski/iavlite/core"
 )
 
+const defaultCheckpointInterval = 1000
+
 type MutableTree struct {
 	version int64
 	root    *Node
 	rootKey *nodeKey
 	pool    *nodePool
 	metrics *core.TreeMetrics
-	db      *memDB
+	db      nodeDB
 
 	// should be part of pool?
-	orphans            []*nodeKey
+	orphans            []orphan
 	overflow           []*Node
 	checkpointInterval int64
+	lastCheckpoint     int64
+
+	// retention and the roots of retained versions. newRoots are the versions recorded and prunedRoots
+	// the persisted versions dropped since the last checkpoint. retainedOrphans are orphans kept in the
+	// db for retained versions.
+	retention       retention
+	roots           map[int64]*nodeKey
+	newRoots        []int64
+	prunedRoots     []int64
+	retainedOrphans []orphan
+	// orphanNodes are copies of saved dirty nodes orphaned while a retained version still needs them,
+	// written by the next checkpoint or writeback.
+	orphanNodes []Node
+	// resident indexes the nodes saved after the last checkpoint which are only in memory, so that reads of
+	// those versions don't need them in the db. It is rebuilt when a lookup misses and may be stale, so
+	// entries are checked against their node key.
+	resident map[nodeKey]*Node
+
+	// writeback enables writing saved dirty nodes back ahead of checkpoints.
+	writeback bool
+
+	// checkpoint is the checkpoint or writeback being committed in the background, if any.
+	checkpoint *checkpoint
+}
+
+// checkpoint is a checkpoint batch committed on a background goroutine, which sends the result on done.
+// A writeback batch holds saved dirty nodes only and leaves the tree metadata as it is.
+type checkpoint struct {
+	version   int64
+	writeback bool
+	done      chan error
+	metrics   *core.TreeMetrics
+}
+
+// LoadTree opens the tree persisted in db at its last checkpoint, or an empty tree if db has none. Only
+// the root is read, the rest of the tree is faulted into a pool of poolSize nodes as it is accessed.
+// Versions saved after the last checkpoint are lost, and any of their nodes written back are deleted.
+func LoadTree(db dbm.DB, poolSize int) (*MutableTree, error) {
+	metrics := &core.TreeMetrics{}
+	kv := newKVDB(db, metrics)
+	return loadTree(kv, newNodePool(kv, poolSize, clockPolicyKind), metrics)
+}
+
+// LoadTreeWithBudget is LoadTree with a pool sized by memory rather than nodes. Nodes are evicted to keep
+// the key, value and hash bytes of the resident nodes, along with the nodes themselves, within budget.
+func LoadTreeWithBudget(db dbm.DB, budget int64) (*MutableTree, error) {
+	metrics := &core.TreeMetrics{}
+	kv := newKVDB(db, metrics)
+	return loadTree(kv, newBudgetedNodePool(kv, budget, clockPolicyKind), metrics)
+}
+
+func loadTree(kv *kvDB, pool *nodePool, metrics *core.TreeMetrics) (*MutableTree, error) {
+	tree := &MutableTree{
+		pool:               pool,
+		metrics:            metrics,
+		db:                 kv,
+		checkpointInterval: defaultCheckpointInterval,
+	}
+	tree.pool.metrics = metrics
+
+	meta, err := kv.Meta()
+	if err != nil {
+		return nil, err
+	}
+	var version int64
+	if meta != nil {
+		version = meta.version
+	}
+	if err := kv.DeleteNodesAfter(version); err != nil {
+		return nil, err
+	}
+	if meta == nil {
+		return tree, nil
+	}
+	if tree.roots, err = kv.Roots(); err != nil {
+		return nil, err
+	}
+	if tree.retainedOrphans, err = kv.Orphans(); err != nil {
+		return nil, err
+	}
+	tree.version = meta.version
+	tree.lastCheckpoint = meta.version
+	tree.rootKey = meta.rootKey
+	if meta.rootKey != nil {
+		root, err := tree.fetchNode(meta.rootKey)
+		if err != nil {
+			return nil, fmt.Errorf("root node fetch failed; %w", err)
+		}
+		tree.setRoot(root)
+	}
+	return tree, nil
 }
 
 func (tree *MutableTree) SaveVersion() ([]byte, int64, error) {
@@ -27,13 +121,27 @@ func (tree *MutableTree) SaveVersion() ([]byte, int64, error) {
 
 	// deepHash flushes to disk and clears overflowed nodes for GC
 	tree.rootKey = tree.deepHash(&sequence, tree.root)
+	tree.recordRoot()
+
+	if err := tree.pollCheckpoint(); err != nil {
+		return nil, 0, err
+	}
 
 	if tree.shouldCheckpoint() {
 		err := tree.Checkpoint()
 		if err != nil {
 			return nil, 0, err
 		}
+	} else if tree.shouldWriteback() {
+		// the nodes of a writeback still in flight stay locked, so waiting for it first keeps the locked
+		// and dirty nodes together near a quarter of the pool.
+		if err := tree.WaitCheckpoint(); err != nil {
+			return nil, 0, err
+		}
+		tree.startWriteback()
 	}
+	// nodes hashed above are accounted at their full size, and written back nodes may now be evicted.
+	tree.pool.shrink()
 
 	// uncomment below to really exercise the pool
 	// tree.root.leftNode = nil
@@ -42,28 +150,153 @@ func (tree *MutableTree) SaveVersion() ([]byte, int64, error) {
 	return tree.root.hash, tree.version, nil
 }
 
+// Checkpoint flushes the dirty nodes of the pool and deletes pruned orphans in a batch committed on a
+// background goroutine, so that the next version can be built meanwhile. The flushed nodes are copied
+// and stay locked in the pool until the batch is committed. Only one checkpoint runs at a time, a
+// previous one is waited on first.
 func (tree *MutableTree) Checkpoint() error {
-	fmt.Printf("checkpointing at version %d\n", tree.version)
-	err := tree.pool.checkpoint(tree.overflow)
-	if err != nil {
+	if err := tree.WaitCheckpoint(); err != nil {
 		return err
 	}
-	for _, overflow := range tree.overflow {
-		tree.pool.FlushNode(overflow)
+	c := &checkpoint{
+		version: tree.version,
+		done:    make(chan error, 1),
+		metrics: &core.TreeMetrics{},
 	}
-	for _, orphan := range tree.orphans {
-		tree.db.Delete(*orphan)
-	}
-	tree.db.lastCheckpoint = tree.version
-	tree.orphans = nil
+	// nodes, orphan deletes and the metadata needed to reopen the tree are committed atomically.
+	batch := tree.db.NewBatch(c.metrics)
+	overflow := len(tree.overflow) > 0
+	nodes := tree.pool.lockDirty(tree.overflow)
 	tree.overflow = nil
+	tree.checkpoint = c
+	tree.lastCheckpoint = tree.version
+	// orphan copies go in ahead of the deletes, so that those pruned by this checkpoint stay deleted.
+	if err := tree.setOrphanNodes(batch); err != nil {
+		c.done <- err
+		return tree.WaitCheckpoint()
+	}
+	if err := tree.pruneOrphans(batch); err != nil {
+		c.done <- err
+		return tree.WaitCheckpoint()
+	}
+	meta := &treeMeta{version: tree.version, rootKey: tree.rootKey}
 
+	go func() {
+		for i := range nodes {
+			if err := batch.Set(&nodes[i]); err != nil {
+				c.done <- err
+				return
+			}
+		}
+		c.done <- batch.Commit(meta)
+	}()
+
+	if !overflow {
+		return nil
+	}
+	// overflow nodes were dropped from the tree and are faulted back from the db, which must have them.
+	if err := tree.WaitCheckpoint(); err != nil {
+		return err
+	}
 	// keep the root node in the pool if it ended up in overflow
-	if tree.root.overflow {
-		tree.root = tree.db.Get(*tree.rootKey)
-		tree.pool.Put(tree.root)
+	if tree.root != nil && tree.root.overflow {
+		root, err := tree.fetchNode(tree.rootKey)
+		if err != nil {
+			return err
+		}
+		tree.setRoot(root)
+	}
+	return nil
+}
+
+// SetWriteback enables writing saved dirty nodes back to the db in the background once they take up an
+// eighth of the pool, so that their frames can be evicted before the dirty nodes reach the overflow
+// ceiling at half the pool. Without it a pool too small for the versions between checkpoints overflows
+// and checkpoints early instead. Written back nodes are committed ahead of the next checkpoint.
+func (tree *MutableTree) SetWriteback(enabled bool) {
+	tree.writeback = enabled
+}
+
+func (tree *MutableTree) shouldWriteback() bool {
+	return tree.writeback && tree.pool.dirtyCount > len(tree.pool.nodes)/8
+}
+
+// startWriteback writes the saved dirty nodes of the pool in a batch committed on a background
+// goroutine. Like a checkpoint, the nodes are copied and stay locked in the pool until it is committed,
+// and the next checkpoint waits for it, so they reach the db before any metadata referring to them.
+func (tree *MutableTree) startWriteback() {
+	nodes := append(tree.pool.lockSaved(), tree.orphanNodes...)
+	tree.orphanNodes = nil
+	if len(nodes) == 0 {
+		return
 	}
+	c := &checkpoint{
+		version:   tree.version,
+		writeback: true,
+		done:      make(chan error, 1),
+		metrics:   &core.TreeMetrics{},
+	}
+	batch := tree.db.NewBatch(c.metrics)
+	tree.checkpoint = c
+	go func() {
+		for i := range nodes {
+			if err := batch.Set(&nodes[i]); err != nil {
+				c.done <- err
+				return
+			}
+		}
+		c.done <- batch.Commit(nil)
+	}()
+}
 
+func (tree *MutableTree) setOrphanNodes(batch nodeBatch) error {
+	for i := range tree.orphanNodes {
+		if err := batch.Set(&tree.orphanNodes[i]); err != nil {
+			return err
+		}
+	}
+	tree.orphanNodes = nil
+	return nil
+}
+
+// WaitCheckpoint blocks until the checkpoint or writeback in progress, if any, is committed and returns
+// its error.
+func (tree *MutableTree) WaitCheckpoint() error {
+	c := tree.checkpoint
+	if c == nil {
+		return nil
+	}
+	return tree.finishCheckpoint(<-c.done)
+}
+
+// pollCheckpoint finishes the checkpoint in progress if it has been committed.
+func (tree *MutableTree) pollCheckpoint() error {
+	if tree.checkpoint == nil {
+		return nil
+	}
+	select {
+	case err := <-tree.checkpoint.done:
+		return tree.finishCheckpoint(err)
+	default:
+		return nil
+	}
+}
+
+func (tree *MutableTree) finishCheckpoint(err error) error {
+	c := tree.checkpoint
+	tree.checkpoint = nil
+	tree.metrics.DbSet += c.metrics.DbSet
+	tree.metrics.DbDelete += c.metrics.DbDelete
+	tree.metrics.DbWriteBytes += c.metrics.DbWriteBytes
+	if unlockErr := tree.pool.unlockDirty(); err == nil {
+		err = unlockErr
+	}
+	if err != nil {
+		if c.writeback {
+			return fmt.Errorf("writeback at version %d failed; %w", c.version, err)
+		}
+		return fmt.Errorf("checkpoint at version %d failed; %w", c.version, err)
+	}
 	return nil
 }
 
@@ -87,11 +320,28 @@ func (tree *MutableTree) Set(key, value []byte) (updated bool, err error) {
 // Get returns the value of the specified key if it exists, or nil otherwise.
 // The returned value must not be modified, since it may point to data stored within IAVL.
 func (tree *MutableTree) Get(key []byte) ([]byte, error) {
+	_, value, err := tree.GetWithIndex(key)
+	return value, err
+}
+
+// GetWithIndex returns the index and value of the specified key if it exists, or the index the key
+// would have and nil otherwise. Evicted nodes on the path are faulted from the db into the pool.
+func (tree *MutableTree) GetWithIndex(key []byte) (int64, []byte, error) {
 	if tree.root == nil {
-		return nil, nil
+		return 0, nil, nil
 	}
+	tree.pool.Hit(tree.root)
+	return tree.root.get(tree, key)
+}
 
-	return tree.Get(key)
+// GetByIndex returns the key and value of the leaf at the given index, or nil if the index is out of
+// range.
+func (tree *MutableTree) GetByIndex(index int64) ([]byte, []byte, error) {
+	if tree.root == nil || index < 0 || index >= tree.root.size {
+		return nil, nil, nil
+	}
+	tree.pool.Hit(tree.root)
+	return tree.root.getByIndex(tree, index)
 }
 
 // Remove removes a key from the working tree. The given key byte slice should not be modified
@@ -100,18 +350,30 @@ func (tree *MutableTree) Remove(key []byte) ([]byte, bool, error) {
 	if tree.root == nil {
 		return nil, false, nil
 	}
-	tree.root.use = true
-	newRoot, _, value, removed, err := tree.recursiveRemove(tree.root, key)
+	tree.pool.Hit(tree.root)
+	// the root may be returned to the pool below so its pin is dropped; recursiveRemove pins the nodes
+	// it holds on to instead.
+	root := tree.root
+	tree.pool.Unpin(root)
+	newRoot, _, value, removed, err := tree.recursiveRemove(root, key)
 	if err != nil {
+		tree.pool.Pin(root)
 		return nil, false, err
 	}
+	if newRoot != nil {
+		tree.pool.Pin(newRoot)
+	}
+	tree.root = newRoot
 	if !removed {
 		return nil, false, nil
 	}
 
 	tree.metrics.TreeDelete++
 
-	tree.root = newRoot
+	if newRoot != nil && newRoot.nodeKey != nil {
+		// a saved child was collapsed into the root.
+		tree.rootKey = newRoot.nodeKey
+	}
 	return value, true, nil
 }
 
@@ -123,11 +385,70 @@ func (tree *MutableTree) Height() int8 {
 	return tree.root.subtreeHeight
 }
 
+// setRoot replaces the root, keeping the new root pinned in the pool so that it is never evicted.
+func (tree *MutableTree) setRoot(root *Node) {
+	if tree.root != nil {
+		tree.pool.Unpin(tree.root)
+	}
+	if root != nil {
+		tree.pool.Pin(root)
+	}
+	tree.root = root
+}
+
+// fetchNode reads the node at nk from the db and places it in the pool.
+func (tree *MutableTree) fetchNode(nk *nodeKey) (*Node, error) {
+	node, err := tree.db.Get(nk)
+	if err != nil {
+		return nil, err
+	}
+	if node == nil && nk.Version() > tree.lastCheckpoint {
+		// nodes of versions saved since the last checkpoint are in memory until written back.
+		if n := tree.residentNode(nk); n != nil {
+			tree.pool.Hit(n)
+			return n, nil
+		}
+	}
+	if node == nil && tree.checkpoint != nil {
+		// a node locked in the pool may be faulted through a parent which was evicted and refetched, before
+		// the checkpoint holding it is committed.
+		if err := tree.WaitCheckpoint(); err != nil {
+			return nil, err
+		}
+		if node, err = tree.db.Get(nk); err != nil {
+			return nil, err
+		}
+	}
+	if node == nil {
+		return nil, fmt.Errorf("node %s not found", nk)
+	}
+	tree.pool.Put(node)
+	return node, nil
+}
+
+// residentNode returns the node of nk from the pool or the orphan copies, or nil if it isn't in memory.
+func (tree *MutableTree) residentNode(nk *nodeKey) *Node {
+	if n := tree.resident[*nk]; n != nil && n.nodeKey != nil && *n.nodeKey == *nk {
+		return n
+	}
+	tree.resident = make(map[nodeKey]*Node)
+	for _, n := range tree.pool.nodes {
+		if n.nodeKey != nil && n.nodeKey.Version() > tree.lastCheckpoint {
+			tree.resident[*n.nodeKey] = n
+		}
+	}
+	for i := range tree.orphanNodes {
+		n := &tree.orphanNodes[i]
+		tree.resident[*n.nodeKey] = n
+	}
+	return tree.resident[*nk]
+}
+
 func (tree *MutableTree) shouldCheckpoint() bool {
 	if tree.overflow != nil {
 		return true
 	}
-	if tree.version-tree.db.lastCheckpoint > tree.checkpointInterval {
+	if tree.version-tree.lastCheckpoint > tree.checkpointInterval {
 		return true
 	}
 	return false
@@ -142,40 +463,50 @@ func (tree *MutableTree) shouldCheckpoint() bool {
 func (tree *MutableTree) recursiveRemove(node *Node, key []byte) (newSelf *Node, newKey []byte, newValue []byte, removed bool, err error) {
 	if node.isLeaf() {
 		if bytes.Equal(key, node.key) {
-			tree.addOrphan(node)
+			if err := tree.addOrphan(node); err != nil {
+				return nil, nil, nil, false, err
+			}
+			value := node.value
 			tree.pool.Return(node)
-			return nil, nil, node.value, true, nil
+			return nil, nil, value, true, nil
 		}
 		return node, nil, nil, false, nil
 	}
 
-	if err != nil {
-		return nil, nil, nil, false, err
-	}
+	// node is held while its subtree is faulted in below. it is unpinned once dirty, or before it is
+	// returned to the pool.
+	tree.pool.Pin(node)
 
 	// node.key < key; we go to the left to find the key:
 	if bytes.Compare(key, node.key) < 0 {
 		newLeftNode, newKey, value, removed, err := tree.recursiveRemove(node.left(tree), key)
 		if err != nil {
+			tree.pool.Unpin(node)
 			return nil, nil, nil, false, err
 		}
 
 		if !removed {
+			tree.pool.Unpin(node)
 			return node, nil, value, removed, nil
 		}
 
-		tree.addOrphan(node)
+		if err := tree.addOrphan(node); err != nil {
+			tree.pool.Unpin(node)
+			return nil, nil, nil, false, err
+		}
 
 		// left node held value, was removed
 		// collapse `node.rightNode` into `node`
 		if newLeftNode == nil {
 			right := node.right(tree)
 			k := node.key
+			tree.pool.Unpin(node)
 			tree.pool.Return(node)
 			return right, k, value, removed, nil
 		}
 
 		tree.mutateNode(node)
+		tree.pool.Unpin(node)
 
 		node.setLeft(newLeftNode)
 		err = node.calcHeightAndSize(tree)
@@ -192,24 +523,31 @@ func (tree *MutableTree) recursiveRemove(node *Node, key []byte) (newSelf *Node,
 	// node.key >= key; either found or look to the right:
 	newRightNode, newKey, value, removed, err := tree.recursiveRemove(node.right(tree), key)
 	if err != nil {
+		tree.pool.Unpin(node)
 		return nil, nil, nil, false, err
 	}
 
 	if !removed {
+		tree.pool.Unpin(node)
 		return node, nil, value, removed, nil
 	}
 
-	tree.addOrphan(node)
+	if err := tree.addOrphan(node); err != nil {
+		tree.pool.Unpin(node)
+		return nil, nil, nil, false, err
+	}
 
 	// right node held value, was removed
 	// collapse `node.leftNode` into `node`
 	if newRightNode == nil {
 		left := node.left(tree)
+		tree.pool.Unpin(node)
 		tree.pool.Return(node)
 		return left, nil, value, removed, nil
 	}
 
 	tree.mutateNode(node)
+	tree.pool.Unpin(node)
 
 	node.setRight(newRightNode)
 	if newKey != nil {
@@ -234,25 +572,30 @@ func (tree *MutableTree) set(key []byte, value []byte) (updated bool, err error)
 	}
 
 	if tree.root == nil {
-		tree.root = tree.pool.Get()
-		tree.root.key = key
-		tree.root.value = value
-		tree.root.size = 1
+		root := tree.pool.Get()
+		root.key = key
+		root.value = value
+		root.size = 1
+		tree.setRoot(root)
 		return updated, nil
 	}
 
-	// todo this is a hack to prevent the root node from being garbage collected
-	// could be fixed by checking rootKey against the root node's key, or pinning root in
-	// the pool
-	tree.root.use = true
-
-	tree.root, updated, err = tree.recursiveSet(tree.root, key, value)
-	return updated, err
+	tree.pool.Hit(tree.root)
+	root, updated, err := tree.recursiveSet(tree.root, key, value)
+	if err != nil {
+		return updated, err
+	}
+	tree.setRoot(root)
+	return updated, nil
 }
 
 func (tree *MutableTree) recursiveSet(node *Node, key []byte, value []byte) (
 	newSelf *Node, updated bool, err error,
 ) {
+	// node is held while its subtree is faulted in and new nodes are allocated below.
+	tree.pool.Pin(node)
+	defer tree.pool.Unpin(node)
+
 	if node.isLeaf() {
 		switch bytes.Compare(key, node.key) {
 		case -1: // setKey < leafKey
@@ -280,7 +623,9 @@ func (tree *MutableTree) recursiveSet(node *Node, key []byte, value []byte) (
 			n.rightNode.size = 1
 			return n, false, nil
 		default:
-			tree.addOrphan(node)
+			if err := tree.addOrphan(node); err != nil {
+				return nil, false, err
+			}
 			node.hash = nil
 			node.nodeKey = nil
 			node.value = value
@@ -288,7 +633,9 @@ func (tree *MutableTree) recursiveSet(node *Node, key []byte, value []byte) (
 			return node, true, nil
 		}
 	} else {
-		tree.addOrphan(node)
+		if err := tree.addOrphan(node); err != nil {
+			return nil, false, err
+		}
 		tree.mutateNode(node)
 
 		var newChild *Node
@@ -339,6 +686,7 @@ func (tree *MutableTree) deepHash(sequence *uint32, node *Node) *nodeKey {
 		node.rightNodeKey = tree.deepHash(sequence, node.right(tree))
 	}
 	node._hash(tree, tree.version)
+	tree.pool.account(node)
 
 	// TODO remove
 	// only flush in checkpoint
@@ -358,11 +706,22 @@ func (tree *MutableTree) deepHash(sequence *uint32, node *Node) *nodeKey {
 	return node.nodeKey
 }
 
-func (tree *MutableTree) addOrphan(n *Node) {
-	// orphans which never made it to the db don't need to be deleted from it.
-	if n.nodeKey != nil && n.nodeKey.Version() <= tree.db.lastCheckpoint {
-		tree.orphans = append(tree.orphans, n.nodeKey)
+func (tree *MutableTree) addOrphan(n *Node) error {
+	if n.nodeKey == nil {
+		return nil
 	}
+	o := orphan{nodeKey: *n.nodeKey, orphanedAt: tree.version + 1}
+	// saved nodes are dirty until flushed by a checkpoint or writeback. orphans which never made it to the
+	// db don't need to be deleted from it, unless a retained version needs them, in which case a copy is
+	// taken before they are mutated.
+	if n.dirty {
+		if !tree.retention.keepsAny(n.nodeKey.Version(), tree.version, tree.version+1) {
+			return nil
+		}
+		tree.orphanNodes = append(tree.orphanNodes, *n)
+	}
+	tree.orphans = append(tree.orphans, o)
+	return nil
 }
 
 func (tree *MutableTree) mutateNode(node *Node) {
@@ -1,11 +1,17 @@
 package v6
 
 import (
+	"bytes"
 	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
 	"testing"
 
+	dbm "github.com/cosmos/cosmos-db"
 	"github.com/dustin/go-humanize"
 	"github.com/kocubinski/iavlite/core"
+	"github.com/kocubinski/iavlite/proof"
 	"github.com/kocubinski/iavlite/testutil"
 	"github.com/stretchr/testify/require"
 )
@@ -27,10 +33,11 @@ func TestTree_Build(t *testing.T) {
 	// overflow on initial changeset
 	//poolSize := 100_000
 
-	db := newMemDB()
+	metrics := &core.TreeMetrics{}
+	db := newMemDB(metrics)
 	tree := &MutableTree{
-		pool:               newNodePool(db, poolSize),
-		metrics:            &core.TreeMetrics{},
+		pool:               newNodePool(db, poolSize, clockPolicyKind),
+		metrics:            metrics,
 		db:                 db,
 		checkpointInterval: 10_000,
 	}
@@ -42,15 +49,13 @@ func TestTree_Build(t *testing.T) {
 	}
 	testutil.TestTreeBuild(t, opts)
 
-	err := tree.Checkpoint()
-	require.NoError(t, err)
+	require.NoError(t, tree.Checkpoint())
+	require.NoError(t, tree.WaitCheckpoint())
 
-	// don't evict root on iteration, it interacts with the node pool
-	tree.root.dirty = true
 	count := pooledTreeCount(tree, *tree.root)
 	height := pooledTreeHeight(tree, *tree.root)
 
-	workingSetCount := -1 // offset the dirty root above.
+	workingSetCount := 0
 	for _, n := range tree.pool.nodes {
 		if n.dirty {
 			workingSetCount++
@@ -61,16 +66,791 @@ func TestTree_Build(t *testing.T) {
 	fmt.Printf("treeCount: %d\n", count)
 	fmt.Printf("treeHeight: %d\n", height)
 	fmt.Printf("db stats:\n sets: %s, deletes: %s\n",
-		humanize.Comma(int64(db.setCount)),
-		humanize.Comma(int64(db.deleteCount)))
+		humanize.Comma(tree.metrics.DbSet),
+		humanize.Comma(tree.metrics.DbDelete))
 
 	require.Equal(t, height, tree.root.subtreeHeight+1)
-	require.Equal(t, count, len(tree.db.nodes))
+	require.Equal(t, count, len(db.nodes))
 	require.Equal(t, tree.pool.dirtyCount, workingSetCount)
 
 	treeAndDbEqual(t, tree, *tree.root)
 }
 
+func newTestTree(poolSize int, checkpointInterval int64) *MutableTree {
+	metrics := &core.TreeMetrics{}
+	return newTestTreeWithDB(newMemDB(metrics), metrics, poolSize, clockPolicyKind, checkpointInterval)
+}
+
+func newTestTreeWithDB(
+	db nodeDB, metrics *core.TreeMetrics, poolSize int, policy evictionPolicyKind, checkpointInterval int64,
+) *MutableTree {
+	tree := &MutableTree{
+		pool:               newNodePool(db, poolSize, policy),
+		metrics:            metrics,
+		db:                 db,
+		checkpointInterval: checkpointInterval,
+	}
+	tree.pool.metrics = tree.metrics
+	return tree
+}
+
+// buildTestTree fills tree with random keys over several versions, removing a few along the way, and
+// returns the expected key-value pairs in key order.
+func buildTestTree(t *testing.T, tree *MutableTree, versions, leavesPerVersion int) ([][]byte, map[string][]byte) {
+	r := rand.New(rand.NewSource(1234))
+	kv := make(map[string][]byte)
+	var inserted [][]byte
+	for v := 0; v < versions; v++ {
+		for i := 0; i < leavesPerVersion; i++ {
+			key := make([]byte, 8)
+			r.Read(key)
+			value := []byte(fmt.Sprintf("value-%d-%d", v, i))
+			_, err := tree.Set(key, value)
+			require.NoError(t, err)
+			kv[string(key)] = value
+			inserted = append(inserted, key)
+		}
+		i := r.Intn(len(inserted))
+		_, removed, err := tree.Remove(inserted[i])
+		require.NoError(t, err)
+		require.True(t, removed)
+		delete(kv, string(inserted[i]))
+		inserted[i] = inserted[len(inserted)-1]
+		inserted = inserted[:len(inserted)-1]
+
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	keys := make([][]byte, 0, len(kv))
+	for k := range kv {
+		keys = append(keys, []byte(k))
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+	return keys, kv
+}
+
+func TestTree_Get(t *testing.T) {
+	tree := newTestTree(1_000, 10)
+	keys, kv := buildTestTree(t, tree, 100, 100)
+	require.NoError(t, tree.Checkpoint())
+	require.NoError(t, tree.WaitCheckpoint())
+	require.Equal(t, int64(len(keys)), tree.Size())
+
+	faults := tree.metrics.PoolFault
+	for i, key := range keys {
+		value, err := tree.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, kv[string(key)], value)
+
+		idx, value, err := tree.GetWithIndex(key)
+		require.NoError(t, err)
+		require.Equal(t, int64(i), idx)
+		require.Equal(t, kv[string(key)], value)
+
+		k, value, err := tree.GetByIndex(int64(i))
+		require.NoError(t, err)
+		require.Equal(t, key, k)
+		require.Equal(t, kv[string(key)], value)
+	}
+	// the pool is much smaller than the tree so reads must fault.
+	require.Greater(t, tree.metrics.PoolFault, faults)
+
+	idx, value, err := tree.GetWithIndex([]byte{})
+	require.NoError(t, err)
+	require.Nil(t, value)
+	require.Equal(t, int64(0), idx)
+
+	idx, value, err = tree.GetWithIndex(bytes.Repeat([]byte{0xff}, 9))
+	require.NoError(t, err)
+	require.Nil(t, value)
+	require.Equal(t, int64(len(keys)), idx)
+
+	k, value, err := tree.GetByIndex(int64(len(keys)))
+	require.NoError(t, err)
+	require.Nil(t, k)
+	require.Nil(t, value)
+}
+
+func TestTree_Iterator(t *testing.T) {
+	tree := newTestTree(1_000, 10)
+	keys, kv := buildTestTree(t, tree, 100, 100)
+	require.NoError(t, tree.Checkpoint())
+	require.NoError(t, tree.WaitCheckpoint())
+
+	cases := []struct {
+		name       string
+		start, end []byte
+		want       [][]byte
+	}{
+		{name: "full", want: keys},
+		{name: "start", start: keys[100], want: keys[100:]},
+		{name: "end", end: keys[200], want: keys[:200]},
+		{name: "range", start: keys[50], end: keys[5_000], want: keys[50:5_000]},
+		{name: "between keys", start: append(keys[10], 0), end: append(keys[20], 0), want: keys[11:21]},
+		{name: "empty", start: keys[30], end: keys[30], want: nil},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, ascending := range []bool{true, false} {
+				faults := tree.metrics.PoolFault
+				itr, err := tree.Iterator(tc.start, tc.end, ascending)
+				require.NoError(t, err)
+				var got [][]byte
+				for ; itr.Valid(); itr.Next() {
+					require.Equal(t, kv[string(itr.Key())], itr.Value())
+					got = append(got, itr.Key())
+				}
+				require.NoError(t, itr.Close())
+				if !ascending {
+					for i, j := 0, len(got)-1; i < j; i, j = i+1, j-1 {
+						got[i], got[j] = got[j], got[i]
+					}
+				}
+				require.Equal(t, tc.want, got)
+				if len(tc.want) > 1_000 {
+					require.Greater(t, tree.metrics.PoolFault, faults)
+				}
+			}
+		})
+	}
+}
+
+func TestTree_KVDB(t *testing.T) {
+	// pebble is only compiled into cosmos-db with the pebbledb build tag.
+	for _, backend := range []dbm.BackendType{dbm.GoLevelDBBackend, dbm.PebbleDBBackend} {
+		t.Run(string(backend), func(t *testing.T) {
+			kvStore, err := dbm.NewDB("v6", backend, t.TempDir())
+			if err != nil && strings.Contains(err.Error(), "unknown db_backend") {
+				t.Skipf("%s backend not built", backend)
+			}
+			require.NoError(t, err)
+			defer kvStore.Close()
+
+			metrics := &core.TreeMetrics{}
+			tree := newTestTreeWithDB(newKVDB(kvStore, metrics), metrics, 1_000, clockPolicyKind, 10)
+			keys, kv := buildTestTree(t, tree, 100, 100)
+			require.NoError(t, tree.Checkpoint())
+			require.NoError(t, tree.WaitCheckpoint())
+
+			// the same changes applied to a map backed tree produce the same root.
+			memTree := newTestTree(1_000, 10)
+			buildTestTree(t, memTree, 100, 100)
+			require.Equal(t, memTree.root.hash, tree.root.hash)
+
+			for i, key := range keys {
+				idx, value, err := tree.GetWithIndex(key)
+				require.NoError(t, err)
+				require.Equal(t, int64(i), idx)
+				require.Equal(t, kv[string(key)], value)
+			}
+			require.Greater(t, metrics.DbReadBytes, int64(0))
+			require.Greater(t, metrics.DbWriteBytes, int64(0))
+			require.Equal(t, memTree.metrics.DbSet, metrics.DbSet)
+			require.Equal(t, memTree.metrics.DbDelete, metrics.DbDelete)
+
+			// every node reachable from the root was persisted and decodes to what is in the pool. the root
+			// is pinned by the tree, so it stays resident while the rest of the tree is faulted in.
+			require.Equal(t, int32(1), tree.pool.pins[tree.root.frameId])
+			treeAndDbEqual(t, tree, *tree.root)
+			require.Equal(t, 0, tree.pool.dirtyCount)
+		})
+	}
+}
+
+func TestTree_LoadTree(t *testing.T) {
+	levelDB, err := dbm.NewGoLevelDB("v6", t.TempDir(), nil)
+	require.NoError(t, err)
+	defer levelDB.Close()
+
+	empty, err := LoadTree(levelDB, 1_000)
+	require.NoError(t, err)
+	require.Nil(t, empty.root)
+	require.Equal(t, int64(0), empty.version)
+
+	metrics := &core.TreeMetrics{}
+	tree := newTestTreeWithDB(newKVDB(levelDB, metrics), metrics, 10_000, clockPolicyKind, 10)
+	buildTestTree(t, tree, 95, 100)
+	checkpoint := tree.lastCheckpoint
+	require.Less(t, checkpoint, tree.version)
+	require.NoError(t, tree.WaitCheckpoint())
+
+	// drop the tree without a final checkpoint, as in a crash. versions since the last checkpoint are lost.
+	loaded, err := LoadTree(levelDB, 1_000)
+	require.NoError(t, err)
+	require.Equal(t, checkpoint, loaded.version)
+
+	expected := newTestTree(1_000, 10)
+	keys, kv := buildTestTree(t, expected, int(checkpoint), 100)
+	require.Equal(t, expected.root.hash, loaded.root.hash)
+	require.Equal(t, expected.Size(), loaded.Size())
+	for _, key := range keys {
+		value, err := loaded.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, kv[string(key)], value)
+	}
+
+	// the reopened tree continues from the checkpoint.
+	for _, tr := range []*MutableTree{expected, loaded} {
+		for i := 0; i < 100; i++ {
+			_, err := tr.Set([]byte(fmt.Sprintf("key-%d", i)), []byte("value"))
+			require.NoError(t, err)
+		}
+		_, _, err = tr.Remove(keys[0])
+		require.NoError(t, err)
+		_, _, err = tr.SaveVersion()
+		require.NoError(t, err)
+	}
+	require.Equal(t, expected.root.hash, loaded.root.hash)
+	require.NoError(t, loaded.Checkpoint())
+	require.NoError(t, loaded.WaitCheckpoint())
+
+	reloaded, err := LoadTree(levelDB, 1_000)
+	require.NoError(t, err)
+	require.Equal(t, checkpoint+1, reloaded.version)
+	require.Equal(t, expected.root.hash, reloaded.root.hash)
+	treeAndDbEqual(t, reloaded, *reloaded.root)
+}
+
+func TestTree_Retention(t *testing.T) {
+	levelDB, err := dbm.NewGoLevelDB("v6", t.TempDir(), nil)
+	require.NoError(t, err)
+	defer levelDB.Close()
+	metrics := &core.TreeMetrics{}
+	tree := newTestTreeWithDB(newKVDB(levelDB, metrics), metrics, 10_000, clockPolicyKind, 10)
+	tree.SetRetention(5, 20)
+	latest := newTestTree(10_000, 10)
+
+	// apply the same changes to a tree retaining only the latest version, keeping the expected state of
+	// every version.
+	r := rand.New(rand.NewSource(1234))
+	hashes := make(map[int64][]byte)
+	states := make(map[int64]map[string][]byte)
+	kv := make(map[string][]byte)
+	var keys [][]byte
+	for v := int64(1); v <= 100; v++ {
+		for i := 0; i < 50; i++ {
+			var key []byte
+			if len(keys) > 0 && r.Intn(2) == 0 {
+				key = keys[r.Intn(len(keys))]
+			} else {
+				key = make([]byte, 8)
+				r.Read(key)
+				keys = append(keys, key)
+			}
+			value := []byte(fmt.Sprintf("value-%d-%d", v, i))
+			for _, tr := range []*MutableTree{tree, latest} {
+				_, err := tr.Set(key, value)
+				require.NoError(t, err)
+			}
+			kv[string(key)] = value
+		}
+		i := r.Intn(len(keys))
+		for _, tr := range []*MutableTree{tree, latest} {
+			_, removed, err := tr.Remove(keys[i])
+			require.NoError(t, err)
+			require.True(t, removed)
+		}
+		delete(kv, string(keys[i]))
+		keys[i] = keys[len(keys)-1]
+		keys = keys[:len(keys)-1]
+
+		hash, version, err := tree.SaveVersion()
+		require.NoError(t, err)
+		require.Equal(t, v, version)
+		latestHash, _, err := latest.SaveVersion()
+		require.NoError(t, err)
+		require.Equal(t, latestHash, hash)
+		hashes[v] = hash
+		states[v] = make(map[string][]byte, len(kv))
+		for k, value := range kv {
+			states[v][k] = value
+		}
+	}
+	require.NoError(t, tree.Checkpoint())
+	require.NoError(t, tree.WaitCheckpoint())
+
+	requireVersion := func(tree *MutableTree, version int64) {
+		itree, err := tree.ImmutableTree(version)
+		require.NoError(t, err)
+		hash, err := itree.Hash()
+		require.NoError(t, err)
+		require.Equal(t, hashes[version], hash)
+		size, err := itree.Size()
+		require.NoError(t, err)
+		require.Equal(t, int64(len(states[version])), size)
+		for k, v := range states[version] {
+			value, err := tree.GetVersioned([]byte(k), version)
+			require.NoError(t, err)
+			require.Equal(t, v, value)
+		}
+	}
+	retained := []int64{20, 40, 60, 80, 96, 97, 98, 99, 100}
+	for _, version := range retained {
+		requireVersion(tree, version)
+	}
+	for _, version := range []int64{1, 50, 95} {
+		_, err := tree.GetVersioned(keys[0], version)
+		require.Error(t, err)
+	}
+
+	// the db holds exactly the nodes of the retained versions.
+	nodes := make(map[nodeKey]bool)
+	for _, version := range retained {
+		collectNodes(t, tree.db, tree.roots[version], nodes)
+	}
+	count := 0
+	itr, err := levelDB.Iterator(nil, nil)
+	require.NoError(t, err)
+	for ; itr.Valid(); itr.Next() {
+		if len(itr.Key()) == nodeKeySize {
+			count++
+		}
+	}
+	require.NoError(t, itr.Close())
+	require.Equal(t, len(nodes), count)
+
+	// retained versions survive a reload.
+	reloaded, err := LoadTree(levelDB, 1_000)
+	require.NoError(t, err)
+	reloaded.SetRetention(5, 20)
+	for _, version := range retained {
+		requireVersion(reloaded, version)
+	}
+}
+
+// collectNodes adds the keys of every node reachable from nk in db to nodes.
+func collectNodes(t *testing.T, db nodeDB, nk *nodeKey, nodes map[nodeKey]bool) {
+	if nk == nil || nodes[*nk] {
+		return
+	}
+	node, err := db.Get(nk)
+	require.NoError(t, err)
+	require.NotNil(t, node, "node %s not found", nk)
+	nodes[*nk] = true
+	if !node.isLeaf() {
+		collectNodes(t, db, node.leftNodeKey, nodes)
+		collectNodes(t, db, node.rightNodeKey, nodes)
+	}
+}
+
+func TestTree_ResidentVersions(t *testing.T) {
+	levelDB, err := dbm.NewGoLevelDB("v6", t.TempDir(), nil)
+	require.NoError(t, err)
+	defer levelDB.Close()
+	metrics := &core.TreeMetrics{}
+	tree := newTestTreeWithDB(newKVDB(levelDB, metrics), metrics, 10_000, clockPolicyKind, 1000)
+	tree.SetRetention(10, 0)
+
+	// versions which update keys of earlier ones, so that their nodes are orphaned before a checkpoint.
+	r := rand.New(rand.NewSource(1234))
+	states := make(map[int64]map[string][]byte)
+	kv := make(map[string][]byte)
+	for v := int64(1); v <= 20; v++ {
+		for i := 0; i < 50; i++ {
+			key := []byte(fmt.Sprintf("key-%d", r.Intn(200)))
+			value := []byte(fmt.Sprintf("value-%d-%d", v, i))
+			_, err := tree.Set(key, value)
+			require.NoError(t, err)
+			kv[string(key)] = value
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		states[v] = make(map[string][]byte, len(kv))
+		for k, value := range kv {
+			states[v][k] = value
+		}
+	}
+
+	// retained versions are read from the pool and the orphan copies, without writing anything.
+	for v := int64(11); v <= 20; v++ {
+		itree, err := tree.ImmutableTree(v)
+		require.NoError(t, err)
+		size, err := itree.Size()
+		require.NoError(t, err)
+		require.Equal(t, int64(len(states[v])), size)
+		for k, value := range states[v] {
+			got, err := itree.Get([]byte(k))
+			require.NoError(t, err)
+			require.Equal(t, value, got)
+		}
+	}
+	require.Zero(t, metrics.DbSet)
+	require.Zero(t, metrics.PoolWriteback)
+	require.Nil(t, tree.checkpoint)
+}
+
+func TestTree_RetentionLowered(t *testing.T) {
+	levelDB, err := dbm.NewGoLevelDB("v6", t.TempDir(), nil)
+	require.NoError(t, err)
+	defer levelDB.Close()
+	metrics := &core.TreeMetrics{}
+	tree := newTestTreeWithDB(newKVDB(levelDB, metrics), metrics, 10_000, clockPolicyKind, 1000)
+	tree.SetRetention(10, 0)
+
+	r := rand.New(rand.NewSource(1234))
+	hashes := make(map[int64][]byte)
+	save := func() {
+		for i := 0; i < 50; i++ {
+			key := make([]byte, 4)
+			r.Read(key)
+			_, err := tree.Set(key, []byte(fmt.Sprintf("value-%d-%d", tree.version, i)))
+			require.NoError(t, err)
+		}
+		hash, version, err := tree.SaveVersion()
+		require.NoError(t, err)
+		hashes[version] = hash
+	}
+	for v := 0; v < 20; v++ {
+		save()
+	}
+	// versions after the last checkpoint are read from memory.
+	itree, err := tree.ImmutableTree(15)
+	require.NoError(t, err)
+	hash, err := itree.Hash()
+	require.NoError(t, err)
+	require.Equal(t, hashes[15], hash)
+	save()
+
+	// narrowing the window drops every root outside it at the next save.
+	tree.SetRetention(2, 0)
+	save()
+	requireRoots := func(tree *MutableTree) {
+		var versions []int64
+		for v := range tree.roots {
+			versions = append(versions, v)
+		}
+		require.ElementsMatch(t, []int64{21, 22}, versions)
+	}
+	requireRoots(tree)
+	require.NoError(t, tree.Checkpoint())
+	require.NoError(t, tree.WaitCheckpoint())
+
+	nodes := make(map[nodeKey]bool)
+	for _, nk := range tree.roots {
+		collectNodes(t, tree.db, nk, nodes)
+	}
+	count := 0
+	itr, err := levelDB.Iterator(nil, nil)
+	require.NoError(t, err)
+	for ; itr.Valid(); itr.Next() {
+		if len(itr.Key()) == nodeKeySize {
+			count++
+		}
+	}
+	require.NoError(t, itr.Close())
+	require.Equal(t, len(nodes), count)
+
+	reloaded, err := LoadTree(levelDB, 1_000)
+	require.NoError(t, err)
+	requireRoots(reloaded)
+	for _, version := range []int64{21, 22} {
+		itree, err := reloaded.ImmutableTree(version)
+		require.NoError(t, err)
+		hash, err := itree.Hash()
+		require.NoError(t, err)
+		require.Equal(t, hashes[version], hash)
+	}
+}
+
+func TestTree_EvictionPolicies(t *testing.T) {
+	var rootHash []byte
+	for _, policy := range evictionPolicyKinds {
+		t.Run(string(policy), func(t *testing.T) {
+			metrics := &core.TreeMetrics{}
+			tree := newTestTreeWithDB(newMemDB(metrics), metrics, 2_000, policy, 10)
+			keys, kv := buildTestTree(t, tree, 100, 100)
+			require.NoError(t, tree.Checkpoint())
+			require.NoError(t, tree.WaitCheckpoint())
+			if rootHash == nil {
+				rootHash = tree.root.hash
+			}
+			require.Equal(t, rootHash, tree.root.hash)
+
+			// read a hot set of keys repeatedly, interleaved with scans over the whole tree.
+			r := rand.New(rand.NewSource(1234))
+			hot := keys[:len(keys)/10]
+			for i := 0; i < 5; i++ {
+				for j := 0; j < 10_000; j++ {
+					key := hot[r.Intn(len(hot))]
+					value, err := tree.Get(key)
+					require.NoError(t, err)
+					require.Equal(t, kv[string(key)], value)
+				}
+				itr, err := tree.Iterator(nil, nil, true)
+				require.NoError(t, err)
+				count := 0
+				for ; itr.Valid(); itr.Next() {
+					count++
+				}
+				require.NoError(t, itr.Close())
+				require.Equal(t, len(keys), count)
+			}
+
+			require.Greater(t, metrics.PoolHit, int64(0))
+			require.Greater(t, metrics.PoolFault, int64(0))
+			require.Greater(t, metrics.PoolEvict, int64(0))
+			fmt.Printf("%s: hits: %s, faults: %s, evicts: %s, evict miss: %s\n", policy,
+				humanize.Comma(metrics.PoolHit),
+				humanize.Comma(metrics.PoolFault),
+				humanize.Comma(metrics.PoolEvict),
+				humanize.Comma(metrics.PoolEvictMiss))
+		})
+	}
+}
+
+func TestTree_Pin(t *testing.T) {
+	tree := newTestTree(2_000, 10)
+	keys, _ := buildTestTree(t, tree, 50, 100)
+	pins := func() int {
+		count := 0
+		for _, p := range tree.pool.pins {
+			count += int(p)
+		}
+		return count
+	}
+	// only the root is pinned between operations.
+	require.Equal(t, 1, pins())
+	require.Equal(t, int32(1), tree.pool.pins[tree.root.frameId])
+
+	itr, err := tree.Iterator(nil, nil, true)
+	require.NoError(t, err)
+	for i := 0; i < len(keys)/2; i++ {
+		itr.Next()
+	}
+	require.Greater(t, pins(), 1)
+	// scanning the rest of the tree must not evict the nodes held by the open iterator.
+	for _, key := range keys {
+		_, err := tree.Get(key)
+		require.NoError(t, err)
+	}
+	count := len(keys) / 2
+	for ; itr.Valid(); itr.Next() {
+		require.Equal(t, keys[count], itr.Key())
+		count++
+	}
+	require.Equal(t, len(keys), count)
+	require.NoError(t, itr.Close())
+	require.Equal(t, 1, pins())
+
+	itr, err = tree.Iterator(nil, nil, false)
+	require.NoError(t, err)
+	require.NoError(t, itr.Close())
+	require.Equal(t, 1, pins())
+
+	root := tree.root
+	require.Panics(t, func() { tree.pool.Return(root) })
+	tree.pool.Pin(root)
+	tree.pool.Unpin(root)
+	require.Equal(t, 1, pins())
+}
+
+func TestTree_Writeback(t *testing.T) {
+	build := func(writeback bool) (*MutableTree, *memDB, *core.TreeMetrics) {
+		metrics := &core.TreeMetrics{}
+		db := newMemDB(metrics)
+		tree := newTestTreeWithDB(db, metrics, 10_000, clockPolicyKind, 100)
+		tree.SetWriteback(writeback)
+		buildTestTree(t, tree, 200, 100)
+		require.NoError(t, tree.Checkpoint())
+		require.NoError(t, tree.WaitCheckpoint())
+		return tree, db, metrics
+	}
+
+	overflowTree, _, overflowMetrics := build(false)
+	tree, db, metrics := build(true)
+	require.Equal(t, overflowTree.root.hash, tree.root.hash)
+
+	require.Greater(t, overflowMetrics.PoolDirtyOverflow, int64(0))
+	require.Equal(t, int64(0), overflowMetrics.PoolWriteback)
+	require.Equal(t, int64(0), metrics.PoolDirtyOverflow)
+	require.Greater(t, metrics.PoolWriteback, int64(0))
+	for name, m := range map[string]*core.TreeMetrics{"overflow": overflowMetrics, "writeback": metrics} {
+		fmt.Printf("%s: dirty overflow: %s, writeback: %s, faults: %s, db sets: %s, db deletes: %s\n", name,
+			humanize.Comma(m.PoolDirtyOverflow),
+			humanize.Comma(m.PoolWriteback),
+			humanize.Comma(m.PoolFault),
+			humanize.Comma(m.DbSet),
+			humanize.Comma(m.DbDelete))
+	}
+
+	// nodes written back and orphaned before the next checkpoint must still be deleted.
+	require.Equal(t, pooledTreeCount(tree, *tree.root), len(db.nodes))
+	treeAndDbEqual(t, tree, *tree.root)
+}
+
+func TestTree_WritebackLoadTree(t *testing.T) {
+	levelDB, err := dbm.NewGoLevelDB("v6", t.TempDir(), nil)
+	require.NoError(t, err)
+	defer levelDB.Close()
+
+	metrics := &core.TreeMetrics{}
+	tree := newTestTreeWithDB(newKVDB(levelDB, metrics), metrics, 10_000, clockPolicyKind, 100)
+	tree.SetWriteback(true)
+	buildTestTree(t, tree, 150, 100)
+	require.NoError(t, tree.WaitCheckpoint())
+	checkpoint := tree.lastCheckpoint
+	require.Less(t, checkpoint, tree.version)
+	require.Greater(t, metrics.PoolWriteback, int64(0))
+
+	nodesAfter := func() int {
+		count := 0
+		itr, err := levelDB.Iterator(newNodeKey(checkpoint+1, 0)[:], nil)
+		require.NoError(t, err)
+		defer itr.Close()
+		for ; itr.Valid(); itr.Next() {
+			if len(itr.Key()) == nodeKeySize {
+				count++
+			}
+		}
+		return count
+	}
+	require.Greater(t, nodesAfter(), 0)
+
+	// drop the tree without a final checkpoint, as in a crash. nodes written back since the last
+	// checkpoint are referenced by no metadata and deleted.
+	loaded, err := LoadTree(levelDB, 1_000)
+	require.NoError(t, err)
+	require.Equal(t, checkpoint, loaded.version)
+	require.Equal(t, 0, nodesAfter())
+
+	expected := newTestTree(10_000, 100)
+	buildTestTree(t, expected, int(checkpoint), 100)
+	require.Equal(t, expected.root.hash, loaded.root.hash)
+}
+
+func TestTree_AsyncCheckpoint(t *testing.T) {
+	levelDB, err := dbm.NewGoLevelDB("v6", t.TempDir(), nil)
+	require.NoError(t, err)
+	defer levelDB.Close()
+
+	metrics := &core.TreeMetrics{}
+	tree := newTestTreeWithDB(newKVDB(levelDB, metrics), metrics, 10_000, clockPolicyKind, 1_000)
+	expected := newTestTree(10_000, 1_000)
+	keys, _ := buildTestTree(t, tree, 20, 100)
+	buildTestTree(t, expected, 20, 100)
+	checkpointHash := tree.root.hash
+
+	// versions built while the checkpoint is committed don't wait on it.
+	require.NoError(t, tree.Checkpoint())
+	require.NotNil(t, tree.checkpoint)
+	for v := 0; v < 5; v++ {
+		for _, tr := range []*MutableTree{tree, expected} {
+			for i := 0; i < 50; i++ {
+				_, err := tr.Set([]byte(fmt.Sprintf("async-%d-%d", v, i)), []byte("value"))
+				require.NoError(t, err)
+			}
+			_, _, err := tr.Remove(keys[v])
+			require.NoError(t, err)
+			_, _, err = tr.SaveVersion()
+			require.NoError(t, err)
+		}
+		require.Equal(t, expected.root.hash, tree.root.hash)
+	}
+	require.NoError(t, tree.WaitCheckpoint())
+	require.Nil(t, tree.checkpoint)
+	for _, n := range tree.pool.nodes {
+		require.False(t, n.lock)
+	}
+	require.Greater(t, metrics.DbSet, int64(0))
+
+	loaded, err := LoadTree(levelDB, 1_000)
+	require.NoError(t, err)
+	require.Equal(t, int64(20), loaded.version)
+	require.Equal(t, checkpointHash, loaded.root.hash)
+	treeAndDbEqual(t, loaded, *loaded.root)
+}
+
+func TestTree_PoolBudget(t *testing.T) {
+	const budget = 2 << 20
+	for _, policy := range evictionPolicyKinds {
+		t.Run(string(policy), func(t *testing.T) {
+			metrics := &core.TreeMetrics{}
+			db := newMemDB(metrics)
+			tree := &MutableTree{
+				pool:               newBudgetedNodePool(db, budget, policy),
+				metrics:            metrics,
+				db:                 db,
+				checkpointInterval: 2,
+			}
+			tree.pool.metrics = metrics
+			expected := newTestTree(100_000, 1_000)
+
+			// values from tens of bytes to tens of KB, so that frames say little about memory.
+			r := rand.New(rand.NewSource(1234))
+			for v := 0; v < 100; v++ {
+				for i := 0; i < 50; i++ {
+					key := []byte(fmt.Sprintf("key-%d", r.Intn(5_000)))
+					value := make([]byte, 40+r.Intn(1<<r.Intn(15)))
+					r.Read(value)
+					for _, tr := range []*MutableTree{tree, expected} {
+						_, err := tr.Set(key, value)
+						require.NoError(t, err)
+					}
+				}
+				for _, tr := range []*MutableTree{tree, expected} {
+					_, _, err := tr.SaveVersion()
+					require.NoError(t, err)
+				}
+				require.Equal(t, expected.root.hash, tree.root.hash)
+
+				var bytes int64
+				resident := 0
+				evictable := false
+				for frame, n := range tree.pool.nodes {
+					if tree.pool.sizes[frame] == 0 {
+						continue
+					}
+					require.Equal(t, nodeBytes(n), tree.pool.sizes[frame])
+					bytes += nodeBytes(n)
+					resident++
+					evictable = evictable || tree.pool.evictable(frame)
+				}
+				require.Equal(t, bytes, metrics.PoolBytes)
+				require.Equal(t, int64(resident), metrics.PoolResident)
+				// the pool only stays over budget while none of its nodes can be evicted.
+				if bytes > budget {
+					require.False(t, evictable)
+				}
+			}
+			require.NoError(t, tree.Checkpoint())
+			require.NoError(t, tree.WaitCheckpoint())
+			require.Greater(t, metrics.PoolEvict, int64(0))
+			require.Less(t, metrics.PoolBytes, int64(budget))
+			treeAndDbEqual(t, tree, *tree.root)
+		})
+	}
+}
+
+// TestTree_ProofHashes checks that the IAVL ops of the proof package hash nodes exactly as writeHashBytes.
+func TestTree_ProofHashes(t *testing.T) {
+	tree := newTestTree(100_000, 1_000)
+	buildTestTree(t, tree, 20, 50)
+
+	var check func(node *Node)
+	check = func(node *Node) {
+		version := node.nodeKey.Version()
+		if node.isLeaf() {
+			hash, err := proof.IavlLeafOp(version).Apply(node.key, node.value)
+			require.NoError(t, err)
+			require.Equal(t, node.hash, hash)
+			return
+		}
+		left, right := node.left(tree), node.right(tree)
+		hash, err := proof.IavlInnerOp(node.subtreeHeight, node.size, version, right.hash, true).Apply(left.hash)
+		require.NoError(t, err)
+		require.Equal(t, node.hash, hash)
+		hash, err = proof.IavlInnerOp(node.subtreeHeight, node.size, version, left.hash, false).Apply(right.hash)
+		require.NoError(t, err)
+		require.Equal(t, node.hash, hash)
+		check(left)
+		check(right)
+	}
+	check(tree.root)
+}
+
 func treeCount(node *Node) int {
 	if node == nil {
 		return 0
@@ -97,7 +877,8 @@ func pooledTreeHeight(tree *MutableTree, node Node) int8 {
 }
 
 func treeAndDbEqual(t *testing.T, tree *MutableTree, node Node) {
-	dbNode := tree.db.Get(*node.nodeKey)
+	dbNode, err := tree.db.Get(node.nodeKey)
+	require.NoError(t, err)
 	require.NotNil(t, dbNode)
 	require.Equal(t, dbNode.hash, node.hash)
 	require.Equal(t, dbNode.nodeKey, node.nodeKey)
@@ -0,0 +1,210 @@
+package v6
+
+import (
+	"fmt"
+)
+
+// retention decides which saved versions stay readable after newer versions are saved. The most recent
+// keepRecent versions are kept along with every version divisible by keepEvery. The zero value keeps
+// only the working tree.
+type retention struct {
+	keepRecent int64
+	keepEvery  int64
+}
+
+// keeps reports whether version is retained while working is the version being built.
+func (r retention) keeps(version, working int64) bool {
+	if version >= working-r.keepRecent {
+		return true
+	}
+	return r.keepEvery > 0 && version%r.keepEvery == 0
+}
+
+// keepsAny reports whether any version in [from, to] is retained while working is the version being
+// built.
+func (r retention) keepsAny(from, to, working int64) bool {
+	if from > to {
+		return false
+	}
+	if r.keeps(to, working) {
+		return true
+	}
+	return r.keepEvery > 0 && to/r.keepEvery*r.keepEvery >= from
+}
+
+// orphan is a node which was replaced in version orphanedAt. It is part of every version from the one
+// encoded in its node key up to orphanedAt-1.
+type orphan struct {
+	nodeKey    nodeKey
+	orphanedAt int64
+}
+
+// SetRetention keeps the last keepRecent saved versions, and every version divisible by keepEvery if it
+// is positive, readable with ImmutableTree. Versions which are no longer retained are pruned at the next
+// checkpoint.
+func (tree *MutableTree) SetRetention(keepRecent, keepEvery int64) {
+	tree.retention = retention{keepRecent: keepRecent, keepEvery: keepEvery}
+}
+
+// recordRoot keeps the root of the version just saved if it is retained, and drops the roots which are
+// no longer retained, including those left behind when SetRetention narrows the window.
+func (tree *MutableTree) recordRoot() {
+	working := tree.version + 1
+	if tree.roots == nil {
+		tree.roots = make(map[int64]*nodeKey)
+	}
+	if tree.retention.keeps(tree.version, working) {
+		tree.roots[tree.version] = tree.rootKey
+		tree.newRoots = append(tree.newRoots, tree.version)
+	}
+	for v := range tree.roots {
+		if tree.retention.keeps(v, working) {
+			continue
+		}
+		delete(tree.roots, v)
+		if v <= tree.lastCheckpoint {
+			tree.prunedRoots = append(tree.prunedRoots, v)
+		}
+	}
+}
+
+// pruneOrphans deletes orphans which are no longer part of a retained version and records the rest so
+// they survive a reload. The changes are written to the checkpoint batch.
+func (tree *MutableTree) pruneOrphans(batch nodeBatch) error {
+	working := tree.version + 1
+	retained := tree.retainedOrphans[:0]
+	for _, o := range tree.retainedOrphans {
+		if tree.retention.keepsAny(o.nodeKey.Version(), o.orphanedAt-1, working) {
+			retained = append(retained, o)
+			continue
+		}
+		nk := o.nodeKey
+		if err := batch.Delete(&nk); err != nil {
+			return err
+		}
+		if err := batch.DeleteOrphan(o); err != nil {
+			return err
+		}
+	}
+	for _, o := range tree.orphans {
+		if tree.retention.keepsAny(o.nodeKey.Version(), o.orphanedAt-1, working) {
+			if err := batch.SetOrphan(o); err != nil {
+				return err
+			}
+			retained = append(retained, o)
+			continue
+		}
+		nk := o.nodeKey
+		if err := batch.Delete(&nk); err != nil {
+			return err
+		}
+	}
+	tree.retainedOrphans = retained
+	tree.orphans = nil
+
+	for _, v := range tree.newRoots {
+		if nk, ok := tree.roots[v]; ok {
+			if err := batch.SetRoot(v, nk); err != nil {
+				return err
+			}
+		}
+	}
+	for _, v := range tree.prunedRoots {
+		if err := batch.DeleteRoot(v); err != nil {
+			return err
+		}
+	}
+	tree.newRoots = nil
+	tree.prunedRoots = nil
+	return nil
+}
+
+// ImmutableTree is a read-only view of a saved version of a MutableTree. Nodes are faulted through the
+// pool of the MutableTree as they are read. A view must not be used once its version is pruned.
+type ImmutableTree struct {
+	tree    *MutableTree
+	version int64
+	rootKey *nodeKey
+	root    *Node
+}
+
+// ImmutableTree returns a view of version, which must be retained.
+func (tree *MutableTree) ImmutableTree(version int64) (*ImmutableTree, error) {
+	rootKey, ok := tree.roots[version]
+	if !ok {
+		return nil, fmt.Errorf("version %d is not retained", version)
+	}
+	// nodes of the version which aren't in the db yet are read from memory, or once the checkpoint or
+	// writeback holding them is committed.
+	return &ImmutableTree{tree: tree, version: version, rootKey: rootKey}, nil
+}
+
+// GetVersioned returns the value of key at version, which must be retained.
+func (tree *MutableTree) GetVersioned(key []byte, version int64) ([]byte, error) {
+	itree, err := tree.ImmutableTree(version)
+	if err != nil {
+		return nil, err
+	}
+	return itree.Get(key)
+}
+
+func (it *ImmutableTree) Version() int64 {
+	return it.version
+}
+
+// fetchRoot faults the root of the view into the pool if it isn't resident.
+func (it *ImmutableTree) fetchRoot() (*Node, error) {
+	if it.rootKey == nil {
+		return nil, nil
+	}
+	if it.root != nil && it.root.nodeKey == it.rootKey {
+		it.tree.pool.Hit(it.root)
+		return it.root, nil
+	}
+	root, err := it.tree.fetchNode(it.rootKey)
+	if err != nil {
+		return nil, fmt.Errorf("root node fetch failed; %w", err)
+	}
+	it.root = root
+	return root, nil
+}
+
+func (it *ImmutableTree) Get(key []byte) ([]byte, error) {
+	_, value, err := it.GetWithIndex(key)
+	return value, err
+}
+
+func (it *ImmutableTree) GetWithIndex(key []byte) (int64, []byte, error) {
+	root, err := it.fetchRoot()
+	if err != nil || root == nil {
+		return 0, nil, err
+	}
+	return root.get(it.tree, key)
+}
+
+func (it *ImmutableTree) GetByIndex(index int64) ([]byte, []byte, error) {
+	root, err := it.fetchRoot()
+	if err != nil || root == nil {
+		return nil, nil, err
+	}
+	if index < 0 || index >= root.size {
+		return nil, nil, nil
+	}
+	return root.getByIndex(it.tree, index)
+}
+
+func (it *ImmutableTree) Size() (int64, error) {
+	root, err := it.fetchRoot()
+	if err != nil || root == nil {
+		return 0, err
+	}
+	return root.size, nil
+}
+
+func (it *ImmutableTree) Hash() ([]byte, error) {
+	root, err := it.fetchRoot()
+	if err != nil || root == nil {
+		return nil, err
+	}
+	return root.hash, nil
+}